@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/JerryG0311/Vidify/internal/pubsub"
+	"github.com/JerryG0311/Vidify/internal/routing"
+)
+
+// delayedInterval is the longest the delayed scheduler sleeps between looks
+// for due jobs. It wakes earlier when the next job is due sooner.
+const delayedInterval = 30 * time.Second
+
+// delayedScheduler holds jobs that should run at a later time, such as a
+// re-encode at 2am, in delayed_jobs. When due they are submitted to the fair
+// scheduler like any other job, so they count against their user's in-flight
+// cap.
+type delayedScheduler struct {
+	db        *sql.DB
+	scheduler *fairScheduler
+	wake      chan struct{}
+}
+
+type delayedJob struct {
+	id            int64
+	jobID         string
+	runAt         time.Time
+	body          []byte
+	correlationID string
+	traceParent   string
+}
+
+func newDelayedScheduler(db *sql.DB, scheduler *fairScheduler) *delayedScheduler {
+	return &delayedScheduler{db: db, scheduler: scheduler, wake: make(chan struct{}, 1)}
+}
+
+// Schedule stores job inside tx to be submitted at runAt, keeping the
+// correlation and trace from env.
+func (s *delayedScheduler) Schedule(tx *sql.Tx, job routing.VideoJob, runAt time.Time, env pubsub.Envelope) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO delayed_jobs (job_id, user_id, run_at, body, correlation_id, trace_parent, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		job.ID, job.UserID, runAt.UTC(), body, env.CorrelationID, env.TraceParent, time.Now().UTC(),
+	)
+	return err
+}
+
+// Notify checks for due jobs now instead of on the next tick.
+func (s *delayedScheduler) Notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run submits due jobs to the fair scheduler until ctx is cancelled.
+func (s *delayedScheduler) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		if err := s.dispatch(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Delayed scheduler: %v", err)
+		}
+
+		timer.Reset(s.untilNext(ctx))
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// untilNext is how long to sleep before the next job is due, at most
+// delayedInterval.
+func (s *delayedScheduler) untilNext(ctx context.Context) time.Duration {
+	var next time.Time
+	err := s.db.QueryRowContext(ctx,
+		"SELECT run_at FROM delayed_jobs WHERE dispatched_at IS NULL AND failed_at IS NULL ORDER BY run_at LIMIT 1",
+	).Scan(&next)
+	if err != nil {
+		return delayedInterval
+	}
+	return min(max(time.Until(next), 0), delayedInterval)
+}
+
+// dispatch submits every job that is due.
+func (s *delayedScheduler) dispatch(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT id, job_id, run_at, body, correlation_id, trace_parent FROM delayed_jobs WHERE dispatched_at IS NULL AND failed_at IS NULL AND run_at <= ? ORDER BY run_at, id",
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return err
+	}
+
+	var due []delayedJob
+	for rows.Next() {
+		var job delayedJob
+		if err := rows.Scan(&job.id, &job.jobID, &job.runAt, &job.body, &job.correlationID, &job.traceParent); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, job)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, job := range due {
+		if err := s.submit(ctx, job); err != nil {
+			return err
+		}
+	}
+	if len(due) > 0 {
+		s.scheduler.Notify()
+	}
+	return nil
+}
+
+// submit moves a due job from delayed_jobs to the fair scheduler's backlog in
+// one transaction, or parks it if its body cannot be decoded.
+func (s *delayedScheduler) submit(ctx context.Context, delayed delayedJob) error {
+	var job routing.VideoJob
+	if err := json.Unmarshal(delayed.body, &job); err != nil {
+		return parkJob(ctx, s.db, "delayed_jobs", delayed.id, delayed.jobID, err)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	env := pubsub.Envelope{CorrelationID: delayed.correlationID, TraceParent: delayed.traceParent}
+	if err := s.scheduler.Submit(tx, job, env); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE delayed_jobs SET dispatched_at = ? WHERE id = ?", time.Now().UTC(), delayed.id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE videos SET status = ? WHERE id = ?", "PENDING", job.ID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Submitted delayed job %s for %s, due %s (correlation=%s)", job.ID, job.UserID, delayed.runAt.Format(time.RFC3339), delayed.correlationID)
+	return nil
+}
+
+// Pending counts user's jobs that are scheduled but not yet due.
+func (s *delayedScheduler) Pending(ctx context.Context, user string) (int, error) {
+	var pending int
+	err := s.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM delayed_jobs WHERE user_id = ? AND dispatched_at IS NULL AND failed_at IS NULL", user,
+	).Scan(&pending)
+	return pending, err
+}
+
+// parseRunAt reads the "at" field of a form: a datetime-local value in the
+// server's time zone or an RFC 3339 time. Empty or past times mean now and
+// return the zero time.
+func parseRunAt(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+
+	runAt, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		runAt, err = time.ParseInLocation("2006-01-02T15:04", raw, time.Local)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse run time %q: %w", raw, err)
+	}
+
+	if !runAt.After(time.Now()) {
+		return time.Time{}, nil
+	}
+	return runAt, nil
+}
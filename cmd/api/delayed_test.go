@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JerryG0311/Vidify/internal/pubsub"
+	"github.com/JerryG0311/Vidify/internal/routing"
+)
+
+func TestDueDelayedJobsWaitForTheirUsersTurn(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	scheduler := newFairScheduler(db, pubsub.NewOutbox(db), 1)
+	delayed := newDelayedScheduler(db, scheduler)
+
+	// The user already has a job running
+	submit(t, db, scheduler, "a@example.com", "vid-running", routing.PriorityNormal)
+	if err := scheduler.dispatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("INSERT INTO videos (id, user_id, status) VALUES ('vid-later', 'a@example.com', 'COMPLETED')"); err != nil {
+		t.Fatal(err)
+	}
+	job := routing.VideoJob{ID: "vid-later", UserID: "a@example.com", TargetFormat: routing.FormatMP4}
+	if err := delayed.Schedule(tx, job, time.Now().Add(time.Hour), pubsub.Envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if wait := delayed.untilNext(ctx); wait != delayedInterval {
+		t.Fatalf("expected to sleep %s with nothing due soon, got %s", delayedInterval, wait)
+	}
+	if _, err := db.Exec("UPDATE delayed_jobs SET run_at = ?", time.Now().UTC().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if wait := delayed.untilNext(ctx); wait != 0 {
+		t.Fatalf("expected no sleep with a job due, got %s", wait)
+	}
+
+	if err := delayed.dispatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := scheduler.dispatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	backlog, err := scheduler.Backlog(ctx, "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backlog.Waiting != 1 || backlog.InFlight != 1 {
+		t.Fatalf("expected the due job to wait behind the running one, got %+v", backlog)
+	}
+	pending, err := delayed.Pending(ctx, "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status string
+	if err := db.QueryRow("SELECT status FROM videos WHERE id = 'vid-later'").Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	if pending != 0 || status != "PENDING" {
+		t.Fatalf("expected the job out of delayed_jobs and its video PENDING, got %d pending and %s", pending, status)
+	}
+}
+
+func TestUndecodableDelayedJobIsParked(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	scheduler := newFairScheduler(db, pubsub.NewOutbox(db), 1)
+	delayed := newDelayedScheduler(db, scheduler)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for _, id := range []string{"vid-bad", "vid-good"} {
+		if _, err := tx.Exec("INSERT INTO videos (id, user_id, status) VALUES (?, 'a@example.com', 'COMPLETED')", id); err != nil {
+			t.Fatal(err)
+		}
+		job := routing.VideoJob{ID: id, UserID: "a@example.com", TargetFormat: routing.FormatMP4}
+		if err := delayed.Schedule(tx, job, time.Now().Add(-time.Second), pubsub.Envelope{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE delayed_jobs SET body = '{' WHERE job_id = 'vid-bad'"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := delayed.dispatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := map[string]string{}
+	rows, err := db.Query("SELECT id, status FROM videos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, status string
+		if err := rows.Scan(&id, &status); err != nil {
+			t.Fatal(err)
+		}
+		statuses[id] = status
+	}
+	// The finished video stays watchable; only its re-process is given up on
+	if statuses["vid-bad"] != "COMPLETED" || statuses["vid-good"] != "PENDING" {
+		t.Fatalf("expected vid-bad left as it was and vid-good submitted, got %v", statuses)
+	}
+	var parked int
+	if err := db.QueryRow("SELECT COUNT(*) FROM delayed_jobs WHERE job_id = 'vid-bad' AND failed_at IS NOT NULL").Scan(&parked); err != nil {
+		t.Fatal(err)
+	}
+	if parked != 1 {
+		t.Fatalf("expected vid-bad parked in delayed_jobs")
+	}
+	if wait := delayed.untilNext(ctx); wait != delayedInterval {
+		t.Fatalf("expected the parked job not to count as due, got a %s sleep", wait)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+
+	"github.com/JerryG0311/Vidify/internal/pubsub"
+	"github.com/JerryG0311/Vidify/internal/routing"
+)
+
+// videoEvents applies the workers' lifecycle events to the videos table; the
+// API is the only process that writes to it. Events can arrive late or more
+// than once, so each update only moves a video forward: nothing but a new
+// job (which resets the status to PENDING) takes a COMPLETED or FAILED video
+// back.
+type videoEvents struct {
+	db        *sql.DB
+	scheduler *fairScheduler
+}
+
+func (v *videoEvents) Handle(event routing.VideoEvent, env pubsub.Envelope) pubsub.AckType {
+	ctx := context.Background()
+
+	var err error
+	switch event.Kind {
+	case routing.EventProcessing:
+		_, err = v.db.ExecContext(ctx,
+			"UPDATE videos SET status = 'PROCESSING', progress = 0, last_error = '' WHERE id = ? AND status NOT IN ('COMPLETED', 'FAILED')",
+			event.VideoID,
+		)
+
+	case routing.EventProgress:
+		_, err = v.db.ExecContext(ctx,
+			"UPDATE videos SET progress = ? WHERE id = ? AND status = 'PROCESSING'",
+			event.Percent, event.VideoID,
+		)
+
+	case routing.EventCompleted:
+		_, err = v.db.ExecContext(ctx, `
+			UPDATE videos
+			SET status = 'COMPLETED',
+				source_path = ?,
+				thumbnail_url = COALESCE(NULLIF(thumbnail_url, ''), ?),
+				duration_seconds = ?,
+				progress = 100,
+				last_error = ''
+			WHERE id = ?`,
+			event.ProcessedURL, event.ThumbnailURL, event.DurationSeconds, event.VideoID,
+		)
+		if err == nil {
+			log.Printf("Video %s completed by %s in %.1fs (correlation=%s)", event.VideoID, event.WorkerID, event.ProcessingSeconds, env.CorrelationID)
+			// The user may have a job waiting for this one's slot
+			v.scheduler.Notify()
+		}
+
+	case routing.EventFailed:
+		if event.Retrying {
+			_, err = v.db.ExecContext(ctx, "UPDATE videos SET last_error = ? WHERE id = ?", event.Error, event.VideoID)
+			break
+		}
+		var result sql.Result
+		result, err = v.db.ExecContext(ctx,
+			"UPDATE videos SET status = 'FAILED', last_error = ? WHERE id = ? AND status != 'COMPLETED'",
+			event.Error, event.VideoID,
+		)
+		if err == nil && rowsChanged(result) {
+			log.Printf("Video %s failed on %s: %s (correlation=%s)", event.VideoID, event.WorkerID, event.Error, env.CorrelationID)
+			v.scheduler.Notify()
+		}
+
+	default:
+		log.Printf("Ignoring video event %s with unknown kind %q", env.MessageID, event.Kind)
+		return pubsub.NackDiscard
+	}
+
+	if err != nil {
+		log.Printf("Failed to apply %s event for video %s: %v", event.Kind, event.VideoID, err)
+		env.RecordError(err)
+		return pubsub.NackRequeue
+	}
+	return pubsub.Ack
+}
+
+func rowsChanged(result sql.Result) bool {
+	n, err := result.RowsAffected()
+	return err == nil && n > 0
+}
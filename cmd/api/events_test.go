@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/JerryG0311/Vidify/internal/pubsub"
+	"github.com/JerryG0311/Vidify/internal/routing"
+)
+
+func TestLateProcessingEventDoesNotReviveAFailedVideo(t *testing.T) {
+	db := openTestDB(t)
+	events := &videoEvents{db: db, scheduler: newFairScheduler(db, pubsub.NewOutbox(db), 2)}
+
+	if _, err := db.Exec("INSERT INTO videos (id, user_id, status) VALUES ('vid-1', 'a@example.com', 'PENDING')"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failure overtook the processing event on its way to the API
+	for _, event := range []routing.VideoEvent{
+		{VideoID: "vid-1", Kind: routing.EventFailed, Error: "ffmpeg: exit status 1"},
+		{VideoID: "vid-1", Kind: routing.EventProcessing},
+		{VideoID: "vid-1", Kind: routing.EventProgress, Percent: 50},
+	} {
+		if ack := events.Handle(event, pubsub.Envelope{}); ack != pubsub.Ack {
+			t.Fatalf("expected the %s event to be acked, got %v", event.Kind, ack)
+		}
+	}
+
+	var status, lastError string
+	if err := db.QueryRow("SELECT status, last_error FROM videos WHERE id = 'vid-1'").Scan(&status, &lastError); err != nil {
+		t.Fatal(err)
+	}
+	if status != "FAILED" || lastError != "ffmpeg: exit status 1" {
+		t.Fatalf("expected the video to stay FAILED with its error, got %s %q", status, lastError)
+	}
+}
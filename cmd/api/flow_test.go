@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/JerryG0311/Vidify/internal/pubsub"
+	"github.com/JerryG0311/Vidify/internal/routing"
+	"github.com/JerryG0311/Vidify/internal/workflow"
+)
+
+// waitForQueue waits until queue has n ready messages.
+func waitForQueue(t *testing.T, memory *pubsub.MemoryBroker, queue string, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for memory.QueueLen(queue) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d message(s) on %s, have %d", n, queue, memory.QueueLen(queue))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestUploadRunsThroughThePipeline(t *testing.T) {
+	db := openTestDB(t)
+	memory := pubsub.NewMemoryBroker()
+	if err := pubsub.ApplyTopology(memory, routing.VideoTopology); err != nil {
+		t.Fatal(err)
+	}
+
+	// The API's background loops and consumers, as main starts them
+	ctx, cancel := context.WithCancel(context.Background())
+	outbox := pubsub.NewOutbox(db)
+	scheduler := newFairScheduler(db, outbox, 2)
+	flows := &workflows{db: db, engine: workflow.NewEngine(db), outbox: outbox, scheduler: scheduler}
+	relayDone, schedulerDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		outbox.Relay(ctx, memory, 10*time.Millisecond)
+	}()
+	go func() {
+		defer close(schedulerDone)
+		scheduler.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-relayDone
+		<-schedulerDone
+	})
+
+	opts := []pubsub.SubscribeOption{pubsub.WithTopology(routing.VideoTopology)}
+	if _, err := pubsub.SubscribeEnvelope(ctx, memory, routing.ExchangeVideoTopic, routing.VideoQueue, routing.VideoUploadKey, pubsub.SimpleQueueQuorum, pubsub.JSON, flows.HandleJob, opts...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pubsub.SubscribeEnvelope(ctx, memory, routing.ExchangeVideoTopic, routing.StepResultQueue, routing.StepResultKey, pubsub.SimpleQueueQuorum, pubsub.JSON, flows.HandleResult, opts...); err != nil {
+		t.Fatal(err)
+	}
+
+	job := routing.VideoJob{ID: "vid-1", SourcePath: "https://bucket/vid-1.mp4", TargetFormat: routing.FormatMP4, UserID: "a@example.com", CreatedAt: time.Now()}
+	if err := saveUpload(ctx, db, scheduler, job, "Holiday", "", "", pubsub.Envelope{CorrelationID: "corr-upload"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The job is released, relayed, turned into a run, and its first step relayed to the workers
+	probeQueue := routing.StepQueue(routing.StepProbe)
+	waitForQueue(t, memory, probeQueue, 1)
+	msg, _ := memory.Get(probeQueue)
+	var probe routing.StepTask
+	if err := json.Unmarshal(msg.Body, &probe); err != nil {
+		t.Fatal(err)
+	}
+	if probe.VideoID != "vid-1" || probe.Step != "probe" || probe.SourcePath != job.SourcePath {
+		t.Fatalf("unexpected first step %+v", probe)
+	}
+	if msg.CorrelationId != "corr-upload" {
+		t.Errorf("expected the step to carry the upload's correlation ID, got %q", msg.CorrelationId)
+	}
+
+	// A worker reports the probe done; the steps that needed it go out next
+	result := routing.StepResult{RunID: probe.RunID, Step: probe.Step, Outputs: map[string]string{"duration_seconds": "12.5"}}
+	if err := pubsub.Publish(pubsub.ContextWithEnvelope(ctx, pubsub.Envelope{CorrelationID: "corr-upload"}), memory, pubsub.JSON, routing.ExchangeVideoTopic, routing.StepResultKey, result); err != nil {
+		t.Fatal(err)
+	}
+	waitForQueue(t, memory, routing.StepQueue(routing.StepThumbnail), 1)
+	waitForQueue(t, memory, routing.StepQueue(routing.StepTranscode), 1)
+
+	backlog, err := scheduler.Backlog(ctx, "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backlog.Waiting != 0 || backlog.InFlight != 1 {
+		t.Fatalf("expected the upload in flight while its run goes, got %+v", backlog)
+	}
+}
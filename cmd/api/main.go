@@ -2,26 +2,33 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/csv"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/JerryG0311/Vidify/internal/pubsub"
 	"github.com/JerryG0311/Vidify/internal/routing"
 	"github.com/JerryG0311/Vidify/internal/storage"
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/JerryG0311/Vidify/internal/workflow"
 )
 
 type VideoData struct {
@@ -684,7 +691,61 @@ func getLoggedInUser(r *http.Request) string {
 	return cookie.Value
 }
 
+// requestEnvelope picks up X-Correlation-ID / X-Request-ID and the W3C
+// traceparent from an incoming request, generating whatever is missing.
+func requestEnvelope(r *http.Request) pubsub.Envelope {
+	correlationID := r.Header.Get("X-Correlation-ID")
+	if correlationID == "" {
+		correlationID = r.Header.Get("X-Request-ID")
+	}
+	if correlationID == "" {
+		correlationID = pubsub.NewMessageID()
+	}
+
+	return pubsub.Envelope{
+		CorrelationID: correlationID,
+		TraceParent:   pubsub.ChildTraceParent(r.Header.Get("traceparent")),
+	}
+}
+
+// saveUpload writes the row of an uploaded video and submits its job in one
+// transaction; the scheduler and the outbox relay take the job from there.
+func saveUpload(ctx context.Context, db *sql.DB, scheduler *fairScheduler, job routing.VideoJob, title, description, playlist string, env pubsub.Envelope) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"INSERT INTO videos (id, user_id, status, source_path, thumbnail_url, title, description, playlist, created_at, views) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		job.ID, job.UserID, "PENDING", job.SourcePath, "", title, description, playlist, job.CreatedAt, 0,
+	)
+	if err != nil {
+		return fmt.Errorf("save video: %w", err)
+	}
+	if err := scheduler.Submit(tx, job, env); err != nil {
+		return fmt.Errorf("queue job: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	scheduler.Notify()
+	return nil
+}
+
 func main() {
+	printTopology := flag.Bool("print-topology", false, "print the RabbitMQ topology the API declares and exit")
+	flag.Parse()
+	if *printTopology {
+		if err := routing.VideoTopology.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	ctx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
 
 	var err error
 	// -- Database  --
@@ -696,36 +757,139 @@ func main() {
 	defer db.Close()
 
 	// -- RabbitMQ Setup --
+	pubsub.AppID = "vidify-api"
 
 	connString := os.Getenv("RABBITMQ_URL")
 	if connString == "" {
 		connString = "amqp://guest@localhost:5672/"
 	}
 
-	var conn *amqp.Connection
-	for i := 0; i < 5; i++ {
-		fmt.Printf("Connecting to RabbitMQ (attempt %d)... ", i+1)
-		conn, err = amqp.Dial(connString)
-		if err == nil {
-			fmt.Println("Connected!")
-			break
-		}
-		time.Sleep(2 * time.Second)
-	}
+	// Reconnects on its own if the broker restarts
+	conn, err := pubsub.Dial(connString)
 	if err != nil {
 		log.Fatalf("Could not connect to RabbitMQ: %v", err)
 	}
 	defer conn.Close()
 
-	// 2. Creating a channel to declare Exchange
-	ch, _ := conn.Channel()
-	defer ch.Close()
+	// Declare Exchanges and Queues (re-declared after every reconnect)
+	// Bodies over 32KB are compressed and those over 1MB go to S3, with a reference in the message
+	var broker pubsub.Broker = pubsub.NewPayloadBroker(conn, pubsub.DefaultPayloadPolicy(storage.Blobs{}))
+	if err := pubsub.ApplyTopology(broker, routing.VideoTopology); err != nil {
+		log.Fatalf("Failed to declare RabbitMQ topology: %v", err)
+	}
+	// Offloaded bodies are never deleted by their consumers, since events also land in the stream
+	if err := storage.ExpireMessages(ctx); err != nil {
+		log.Printf("Could not set the S3 lifecycle rule for offloaded messages: %v", err)
+	}
 
-	// Declare Exchanges and Queues
-	ch.ExchangeDeclare(routing.ExchangeVideoTopic, "topic", true, false, false, false, nil)
-	ch.ExchangeDeclare(routing.ExchangeVideoDLX, "fanout", true, false, false, false, nil)
-	ch.QueueDeclare(routing.VideoDLQueue, true, false, false, false, nil)
-	ch.QueueBind(routing.VideoDLQueue, "", routing.ExchangeVideoDLX, false, nil)
+	// Jobs are written to the outbox with their video row and published from here
+	outbox := pubsub.NewOutbox(db)
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		outbox.Relay(ctx, broker, pubsub.DefaultRelayInterval)
+	}()
+
+	// Uploads wait in a per-user backlog and reach the outbox a few at a time per user
+	maxInFlight := defaultMaxInFlightPerUser
+	if raw := os.Getenv("MAX_INFLIGHT_PER_USER"); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			maxInFlight = parsed
+		} else {
+			log.Printf("Invalid MAX_INFLIGHT_PER_USER %q, using %d", raw, maxInFlight)
+		}
+	}
+	scheduler := newFairScheduler(db, outbox, maxInFlight)
+	schedulerDone := make(chan struct{})
+	go func() {
+		defer close(schedulerDone)
+		scheduler.Run(ctx)
+	}()
+
+	// Jobs for later (re-process at 2am) wait in delayed_jobs until they are due
+	delayed := newDelayedScheduler(db, scheduler)
+	delayedDone := make(chan struct{})
+	go func() {
+		defer close(delayedDone)
+		delayed.Run(ctx)
+	}()
+
+	// Workers report progress as events; only the API writes video status to the database.
+	// One at a time so a video's events are applied in the order they were sent.
+	events := &videoEvents{db: db, scheduler: scheduler}
+	eventsSub, err := pubsub.SubscribeEnvelope(
+		ctx,
+		broker,
+		routing.ExchangeVideoTopic,
+		routing.VideoStatusQueue,
+		routing.VideoCompletedKey, // the other event keys are bound by ApplyTopology
+		pubsub.SimpleQueueQuorum,
+		pubsub.JSON,
+		events.Handle,
+		pubsub.WithTopology(routing.VideoTopology),
+	)
+	if err != nil {
+		log.Fatalf("Failed to subscribe to video events: %v", err)
+	}
+	go func() {
+		for err := range eventsSub.Errors() {
+			log.Printf("Video events subscription error: %v", err)
+		}
+	}()
+
+	// Released jobs start a pipeline run here; its steps go to the workers one by one,
+	// and each result queues the steps that were waiting for it
+	engine := workflow.NewEngine(db)
+	flows := &workflows{db: db, engine: engine, outbox: outbox, scheduler: scheduler}
+	jobsSub, err := pubsub.SubscribeEnvelope(
+		ctx,
+		broker,
+		routing.ExchangeVideoTopic,
+		routing.VideoQueue,
+		routing.VideoUploadKey,
+		pubsub.SimpleQueueQuorum,
+		pubsub.JSON,
+		flows.HandleJob,
+		pubsub.WithTopology(routing.VideoTopology),
+		pubsub.WithPoisonLimit(routing.VideoPoisonLimit),
+		pubsub.WithMiddleware(
+			pubsub.Logging[routing.VideoJob](slog.Default()),
+			pubsub.Recover[routing.VideoJob](),
+		),
+	)
+	if err != nil {
+		log.Fatalf("Failed to subscribe to video jobs: %v", err)
+	}
+	stepsSub, err := pubsub.SubscribeEnvelope(
+		ctx,
+		broker,
+		routing.ExchangeVideoTopic,
+		routing.StepResultQueue,
+		routing.StepResultKey,
+		pubsub.SimpleQueueQuorum,
+		pubsub.JSON,
+		flows.HandleResult,
+		pubsub.WithTopology(routing.VideoTopology),
+	)
+	if err != nil {
+		log.Fatalf("Failed to subscribe to step results: %v", err)
+	}
+	// Fails runs whose step was lost, so neither the run nor the user's slot is held forever
+	sweepDone := make(chan struct{})
+	go func() {
+		defer close(sweepDone)
+		flows.Sweep(ctx)
+	}()
+	go func() {
+		for err := range jobsSub.Errors() {
+			log.Printf("Video jobs subscription error: %v", err)
+		}
+	}()
+	go func() {
+		for err := range stepsSub.Errors() {
+			log.Printf("Step results subscription error: %v", err)
+		}
+	}()
 
 	// ---- AUTH HANDLERS ----
 	http.HandleFunc("/signup", func(w http.ResponseWriter, r *http.Request) {
@@ -1056,12 +1220,28 @@ func main() {
 				title = header.Filename
 			}
 
+			var tier string
+			if err := db.QueryRow("SELECT tier FROM users WHERE email = ?", userEmail).Scan(&tier); err != nil {
+				log.Printf("Could not load tier for %s, using default priority: %v", userEmail, err)
+			}
+
+			// The optional format field picks the pipeline: mp4 (the default) or hls
+			format := r.FormValue("format")
+			if format == "" {
+				format = routing.FormatMP4
+			}
+			if _, err := routing.PipelineFor(format); err != nil {
+				http.Error(w, "Unsupported format", http.StatusBadRequest)
+				return
+			}
+
 			job := routing.VideoJob{
 				ID:           fmt.Sprintf("vid-%d", time.Now().Unix()),
 				SourcePath:   "",
-				TargetFormat: "mp4",
+				TargetFormat: format,
 				UserID:       userEmail,
 				CreatedAt:    time.Now(),
+				Priority:     routing.JobPriority(header.Size, tier, false),
 			}
 
 			s3URL, err := storage.UploadToS3(header.Filename, file)
@@ -1071,11 +1251,17 @@ func main() {
 			}
 			job.SourcePath = s3URL
 
-			_, err = db.Exec(
-				"INSERT INTO videos (id, user_id, status, source_path, thumbnail_url, title, description, playlist, created_at, views) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-				job.ID, userEmail, "PENDING", job.SourcePath, "", title, description, playlist, job.CreatedAt, 0,
-			)
-			pubsub.PublishJSON(ch, routing.ExchangeVideoTopic, routing.VideoUploadKey, job)
+			// Carry the caller's correlation ID and trace context through to the worker
+			env := requestEnvelope(r)
+			w.Header().Set("X-Correlation-ID", env.CorrelationID)
+
+			if err := saveUpload(r.Context(), db, scheduler, job, title, description, playlist, env); err != nil {
+				log.Printf("Error saving video %s (correlation=%s): %v", job.ID, env.CorrelationID, err)
+				http.Error(w, "Failed to save video", http.StatusInternalServerError)
+				return
+			}
+
+			log.Printf("Queued job %s for %s with priority %d (correlation=%s trace=%s)", job.ID, userEmail, job.Priority, env.CorrelationID, env.TraceID())
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -1084,14 +1270,95 @@ func main() {
 	http.HandleFunc("/status/", func(w http.ResponseWriter, r *http.Request) {
 		id := filepath.Base(r.URL.Path)
 
-		var status string
-		err := db.QueryRow("SELECT status FROM videos WHERE id = ?", id).Scan(&status)
+		var status, lastError string
+		var progress int
+		err := db.QueryRow("SELECT status, COALESCE(progress, 0), COALESCE(last_error, '') FROM videos WHERE id = ?", id).Scan(&status, &progress, &lastError)
 		if err != nil {
 			http.Error(w, "Not found", 404)
 			return
 		}
 
 		fmt.Fprintf(w, "Video ID: %s\nStatus: %s", id, status)
+		if status == "PROCESSING" {
+			fmt.Fprintf(w, "\nProgress: %d%%", progress)
+		}
+		if lastError != "" {
+			fmt.Fprintf(w, "\nLast error: %s", lastError)
+		}
+
+		run, steps, err := engine.Latest(r.Context(), id)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "\nPipeline: %s (%s)", run.Pipeline, strings.ToLower(run.Status))
+		for _, step := range steps {
+			fmt.Fprintf(w, "\n  %-16s %s", step.Name, strings.ToLower(step.Status))
+			if step.Attempts > 1 {
+				fmt.Fprintf(w, " after %d attempts", step.Attempts)
+			}
+			if step.Error != "" {
+				fmt.Fprintf(w, ": %s", step.Error)
+			}
+		}
+	})
+
+	// Publish, delivery and handler metrics from internal/pubsub for Prometheus
+	http.Handle("/metrics", promhttp.Handler())
+
+	// How many of the caller's jobs are waiting for their turn and how many are being processed
+	http.HandleFunc("/backlog", func(w http.ResponseWriter, r *http.Request) {
+		userEmail := getLoggedInUser(r)
+		if userEmail == "" {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "You must be logged in to see your backlog."})
+			return
+		}
+
+		backlog, err := scheduler.Backlog(r.Context(), userEmail)
+		if err == nil {
+			backlog.Scheduled, err = delayed.Pending(r.Context(), userEmail)
+		}
+		if err != nil {
+			log.Printf("Backlog lookup for %s failed: %v", userEmail, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "Could not load backlog."})
+			return
+		}
+		writeJSON(w, http.StatusOK, backlog)
+	})
+
+	// Asks a worker for the video's duration and waits for the answer
+	http.HandleFunc("/probe/", func(w http.ResponseWriter, r *http.Request) {
+		userEmail := getLoggedInUser(r)
+		if userEmail == "" {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "You must be logged in to probe a video."})
+			return
+		}
+
+		id := filepath.Base(r.URL.Path)
+		var sourcePath string
+		err := db.QueryRow("SELECT source_path FROM videos WHERE id = ? AND user_id = ?", id, userEmail).Scan(&sourcePath)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "Video not found."})
+			return
+		}
+
+		callCtx, cancel := context.WithTimeout(pubsub.ContextWithEnvelope(r.Context(), requestEnvelope(r)), 30*time.Second)
+		defer cancel()
+
+		result, err := pubsub.Call[routing.ProbeRequest, routing.ProbeResult](
+			callCtx,
+			broker,
+			pubsub.JSON,
+			routing.ExchangeVideoTopic,
+			routing.VideoProbeKey,
+			routing.ProbeRequest{VideoID: id, SourcePath: sourcePath},
+		)
+		if err != nil {
+			log.Printf("Probe for video %s failed: %v", id, err)
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "Could not probe video right now."})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, result)
 	})
 
 	http.Handle("/data/", http.StripPrefix("/data/", http.FileServer(http.Dir("./data"))))
@@ -1762,10 +2029,158 @@ func main() {
 	})
 
 	http.HandleFunc("/delete/", func(w http.ResponseWriter, r *http.Request) {
+		userEmail := getLoggedInUser(r)
+		if userEmail == "" {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
 		id := filepath.Base(r.URL.Path)
+
+		var status, owner string
+		err := db.QueryRow("SELECT COALESCE(status, ''), COALESCE(user_id, '') FROM videos WHERE id = ? AND user_id = ?", id, userEmail).Scan(&status, &owner)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not found", 404)
+			return
+		}
+		if err != nil {
+			log.Printf("Error looking up video %s for delete: %v", id, err)
+			http.Error(w, "Failed to delete video", http.StatusInternalServerError)
+			return
+		}
+
+		env := requestEnvelope(r)
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			log.Printf("Error starting transaction to delete video %s: %v", id, err)
+			http.Error(w, "Failed to delete video", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		for _, query := range []string{
+			"DELETE FROM videos WHERE id = ?",
+			// Drop the job too if it is still waiting for its turn
+			"DELETE FROM scheduled_jobs WHERE job_id = ? AND dispatched_at IS NULL",
+			"DELETE FROM delayed_jobs WHERE job_id = ? AND dispatched_at IS NULL",
+		} {
+			if _, err := tx.Exec(query, id); err != nil {
+				log.Printf("Error deleting video %s: %v", id, err)
+				http.Error(w, "Failed to delete video", http.StatusInternalServerError)
+				return
+			}
+		}
+		// Forgetting its runs makes late step results no-ops and lists the files its steps wrote
+		artifacts, err := engine.Delete(r.Context(), tx, id)
+		if err != nil {
+			log.Printf("Error deleting pipeline runs of %s: %v", id, err)
+			http.Error(w, "Failed to delete video", http.StatusInternalServerError)
+			return
+		}
+
+		// A job already sent to RabbitMQ would otherwise finish and upload the processed file again
+		cancelJob := status == "PENDING" || status == "PROCESSING"
+		if cancelJob {
+			cancel := routing.VideoCancel{VideoID: id, UserID: owner, RequestedAt: time.Now().UTC(), Reason: "deleted"}
+			if err := pubsub.Enqueue(pubsub.ContextWithEnvelope(r.Context(), env), tx, pubsub.JSON, routing.ExchangeVideoTopic, routing.VideoCancelKey, cancel); err != nil {
+				log.Printf("Error queueing cancellation of %s (correlation=%s): %v", id, env.CorrelationID, err)
+				http.Error(w, "Failed to delete video", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing delete of %s: %v", id, err)
+			http.Error(w, "Failed to delete video", http.StatusInternalServerError)
+			return
+		}
 		storage.DeleteFromS3(id + "_processed.mp4")
 		storage.DeleteFromS3(id + "_thumb.jpg")
-		db.Exec("DELETE FROM videos WHERE id = ?", id)
+		for _, key := range artifacts {
+			storage.DeleteFromS3(key)
+		}
+		if cancelJob {
+			outbox.Notify()
+			log.Printf("Cancelled %s job for deleted video %s (correlation=%s)", strings.ToLower(status), id, env.CorrelationID)
+		}
+		http.Redirect(w, r, "/gallery", 303)
+	})
+
+	// Runs a video through the worker again, ahead of regular uploads, either
+	// now or at the time in the optional "at" field
+	http.HandleFunc("/reprocess/", func(w http.ResponseWriter, r *http.Request) {
+		userEmail := getLoggedInUser(r)
+		if userEmail == "" {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Redirect(w, r, "/gallery", 303)
+			return
+		}
+
+		id := filepath.Base(r.URL.Path)
+		job := routing.VideoJob{ID: id, TargetFormat: routing.FormatMP4, UserID: userEmail, CreatedAt: time.Now(), Priority: routing.JobPriority(0, "", true)}
+		err := db.QueryRow("SELECT source_path FROM videos WHERE id = ? AND user_id = ?", id, userEmail).Scan(&job.SourcePath)
+		if err != nil {
+			http.Error(w, "Not found", 404)
+			return
+		}
+		// Run the same pipeline as last time
+		if run, _, err := engine.Latest(r.Context(), id); err == nil {
+			job.TargetFormat = run.Pipeline
+		}
+
+		runAt, err := parseRunAt(r.FormValue("at"))
+		if err != nil {
+			http.Error(w, "Invalid time, use YYYY-MM-DDTHH:MM or RFC 3339", http.StatusBadRequest)
+			return
+		}
+
+		env := requestEnvelope(r)
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			log.Printf("Error starting transaction for video %s: %v", id, err)
+			http.Error(w, "Failed to re-process video", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if !runAt.IsZero() {
+			// The status stays as it is until the job is due
+			if err := delayed.Schedule(tx, job, runAt, env); err != nil {
+				log.Printf("Error scheduling re-process of %s (correlation=%s): %v", id, env.CorrelationID, err)
+				http.Error(w, "Failed to re-process video", http.StatusInternalServerError)
+				return
+			}
+			if err := tx.Commit(); err != nil {
+				log.Printf("Error committing scheduled re-process of %s: %v", id, err)
+				http.Error(w, "Failed to re-process video", http.StatusInternalServerError)
+				return
+			}
+			delayed.Notify()
+
+			log.Printf("Scheduled re-process of %s for %s at %s (correlation=%s)", id, userEmail, runAt.Format(time.RFC3339), env.CorrelationID)
+			http.Redirect(w, r, "/gallery", 303)
+			return
+		}
+
+		if _, err := tx.Exec("UPDATE videos SET status = ? WHERE id = ?", "PENDING", id); err != nil {
+			log.Printf("Error resetting status for video %s: %v", id, err)
+			http.Error(w, "Failed to re-process video", http.StatusInternalServerError)
+			return
+		}
+		if err := scheduler.Submit(tx, job, env); err != nil {
+			log.Printf("Error queueing re-process of %s (correlation=%s): %v", id, env.CorrelationID, err)
+			http.Error(w, "Failed to re-process video", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Error committing re-process of %s: %v", id, err)
+			http.Error(w, "Failed to re-process video", http.StatusInternalServerError)
+			return
+		}
+		scheduler.Notify()
+
+		log.Printf("Queued re-process of %s for %s with priority %d (correlation=%s)", id, userEmail, job.Priority, env.CorrelationID)
 		http.Redirect(w, r, "/gallery", 303)
 	})
 
@@ -2648,5 +3063,35 @@ func main() {
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("web/static"))))
 
 	fmt.Println("Vidify web server running on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	server := &http.Server{Addr: ":8080"}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stopSignals()
+	fmt.Println("Shutting down API...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP server shutdown error: %v", err)
+	}
+	if err := jobsSub.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Video jobs shutdown incomplete: %v", err)
+	}
+	if err := stepsSub.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Step results shutdown incomplete: %v", err)
+	}
+	if err := eventsSub.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Video events shutdown incomplete: %v", err)
+	}
+	<-delayedDone
+	<-sweepDone
+	<-schedulerDone
+	<-relayDone
 }
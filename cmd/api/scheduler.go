@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/JerryG0311/Vidify/internal/pubsub"
+	"github.com/JerryG0311/Vidify/internal/routing"
+)
+
+const (
+	defaultMaxInFlightPerUser = 2
+	schedulerInterval         = 2 * time.Second
+	// How long a dispatched job counts as in flight before its pipeline run
+	// starts. A job that never starts one (dead-lettered, undecodable) frees
+	// its slot after this.
+	jobStartGrace = 15 * time.Minute
+	// Dispatched rows are kept this long for debugging, then pruned
+	scheduledRetention = 7 * 24 * time.Hour
+)
+
+// fairScheduler keeps one user from monopolizing the workers. Jobs wait in
+// scheduled_jobs and are released to the outbox round-robin across users,
+// never more than maxInFlight per user at a time. A job stays in flight
+// while its pipeline run is RUNNING with a step heard from within
+// staleStepAfter, or for jobStartGrace until one starts, and never once its
+// video is COMPLETED, FAILED or deleted.
+type fairScheduler struct {
+	db          *sql.DB
+	outbox      *pubsub.Outbox
+	maxInFlight int
+	wake        chan struct{}
+}
+
+// userBacklog is what /backlog reports for a user.
+type userBacklog struct {
+	Waiting     int `json:"waiting"`
+	InFlight    int `json:"in_flight"`
+	MaxInFlight int `json:"max_in_flight"`
+	Scheduled   int `json:"scheduled"` // delayed jobs that are not due yet
+}
+
+type waitingJob struct {
+	id            int64
+	jobID         string
+	userID        string
+	body          []byte
+	correlationID string
+	traceParent   string
+}
+
+// inFlightQuery counts dispatched jobs whose video has not finished and whose
+// run is going or about to start, per user. It takes the start grace cutoff
+// and the stale step cutoff, so a stuck run stops counting even before the
+// sweep fails it.
+const inFlightQuery = `
+	SELECT s.user_id, COUNT(DISTINCT s.job_id)
+	FROM scheduled_jobs s
+	JOIN videos v ON v.id = s.job_id
+	WHERE s.dispatched_at IS NOT NULL
+		AND v.status NOT IN ('COMPLETED', 'FAILED')
+		AND (
+			s.dispatched_at > ?
+			OR EXISTS (
+				SELECT 1
+				FROM workflow_runs r
+				JOIN workflow_steps st ON st.run_id = r.id
+				WHERE r.video_id = s.job_id
+					AND r.status = 'RUNNING'
+					AND st.status = 'QUEUED'
+					AND st.queued_at > ?
+			)
+		)
+	GROUP BY s.user_id
+`
+
+func newFairScheduler(db *sql.DB, outbox *pubsub.Outbox, maxInFlight int) *fairScheduler {
+	return &fairScheduler{db: db, outbox: outbox, maxInFlight: maxInFlight, wake: make(chan struct{}, 1)}
+}
+
+// Submit adds job to its user's backlog inside tx, keeping the correlation
+// and trace from env for when it is finally published.
+func (s *fairScheduler) Submit(tx *sql.Tx, job routing.VideoJob, env pubsub.Envelope) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO scheduled_jobs (job_id, user_id, priority, body, correlation_id, trace_parent, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		job.ID, job.UserID, job.Priority, body, env.CorrelationID, env.TraceParent, time.Now().UTC(),
+	)
+	return err
+}
+
+// Notify runs a dispatch pass now instead of on the next tick.
+func (s *fairScheduler) Notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run dispatches waiting jobs until ctx is cancelled. Finished jobs are only
+// noticed on the tick, so a user's next job waits at most schedulerInterval.
+func (s *fairScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	lastPrune := time.Time{}
+	for {
+		if err := s.dispatch(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Fair scheduler: %v", err)
+		}
+
+		if time.Since(lastPrune) > time.Hour {
+			s.prune()
+			lastPrune = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+func (s *fairScheduler) dispatch(ctx context.Context) error {
+	inFlight, err := s.inFlight(ctx)
+	if err != nil {
+		return err
+	}
+
+	waiting, users, err := s.waiting(ctx)
+	if err != nil {
+		return err
+	}
+
+	// One job per user per round, so a long backlog only ever gets its share
+	dispatched := 0
+	for progress := true; progress; {
+		progress = false
+		for _, user := range users {
+			if inFlight[user] >= s.maxInFlight || len(waiting[user]) == 0 {
+				continue
+			}
+
+			job := waiting[user][0]
+			waiting[user] = waiting[user][1:]
+			released, err := s.release(ctx, job)
+			if err != nil {
+				return err
+			}
+			if released {
+				inFlight[user]++
+				dispatched++
+			}
+			progress = true
+		}
+	}
+
+	if dispatched > 0 {
+		s.outbox.Notify()
+	}
+	return nil
+}
+
+func (s *fairScheduler) inFlight(ctx context.Context) (map[string]int, error) {
+	now := time.Now().UTC()
+	rows, err := s.db.QueryContext(ctx, inFlightQuery, now.Add(-jobStartGrace), now.Add(-staleStepAfter))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var user string
+		var count int
+		if err := rows.Scan(&user, &count); err != nil {
+			return nil, err
+		}
+		counts[user] = count
+	}
+	return counts, rows.Err()
+}
+
+// waitingQuery lists undispatched jobs that are not parked, grouped by user, the user whose oldest
+// waiting job was submitted first leading, and each user's jobs highest
+// priority and oldest first.
+const waitingQuery = `
+SELECT id, job_id, user_id, body, correlation_id, trace_parent
+FROM scheduled_jobs
+WHERE dispatched_at IS NULL AND failed_at IS NULL
+WINDOW w AS (PARTITION BY user_id)
+ORDER BY MIN(created_at) OVER w, MIN(id) OVER w, priority DESC, id`
+
+// waiting returns each user's undispatched jobs, highest priority and oldest
+// first, and the users ordered by who has waited longest.
+func (s *fairScheduler) waiting(ctx context.Context) (map[string][]waitingJob, []string, error) {
+	rows, err := s.db.QueryContext(ctx, waitingQuery)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	byUser := map[string][]waitingJob{}
+	var users []string
+	for rows.Next() {
+		var job waitingJob
+		if err := rows.Scan(&job.id, &job.jobID, &job.userID, &job.body, &job.correlationID, &job.traceParent); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := byUser[job.userID]; !ok {
+			users = append(users, job.userID)
+		}
+		byUser[job.userID] = append(byUser[job.userID], job)
+	}
+	return byUser, users, rows.Err()
+}
+
+// release moves a job from the backlog to the outbox in one transaction. A
+// job whose body cannot be decoded is parked instead, and release reports
+// false.
+func (s *fairScheduler) release(ctx context.Context, waiting waitingJob) (bool, error) {
+	var job routing.VideoJob
+	if err := json.Unmarshal(waiting.body, &job); err != nil {
+		return false, parkJob(ctx, s.db, "scheduled_jobs", waiting.id, waiting.jobID, err)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	env := pubsub.Envelope{CorrelationID: waiting.correlationID, TraceParent: waiting.traceParent}
+	if err := pubsub.Enqueue(pubsub.ContextWithEnvelope(ctx, env), tx, pubsub.JSON, routing.ExchangeVideoTopic, routing.VideoUploadKey, job); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("UPDATE scheduled_jobs SET dispatched_at = ? WHERE id = ?", time.Now().UTC(), waiting.id); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	log.Printf("Dispatched job %s for %s (correlation=%s)", job.ID, job.UserID, waiting.correlationID)
+	return true, nil
+}
+
+// parkJob sets aside a row of table (scheduled_jobs or delayed_jobs) whose
+// body cannot be decoded, the way the outbox parks messages it cannot send,
+// so it stops holding up every pass. Its video is failed, since the job will
+// never run, unless it already completed and the job was a re-process.
+func parkJob(ctx context.Context, db *sql.DB, table string, id int64, jobID string, cause error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE "+table+" SET failed_at = ?, last_error = ? WHERE id = ?", time.Now().UTC(), cause.Error(), id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE videos SET status = 'FAILED' WHERE id = ? AND status != 'COMPLETED'", jobID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Parked job %s in %s, its body cannot be decoded: %v", jobID, table, cause)
+	return nil
+}
+
+func (s *fairScheduler) prune() {
+	cutoff := time.Now().UTC().Add(-scheduledRetention)
+	if _, err := s.db.Exec("DELETE FROM scheduled_jobs WHERE dispatched_at IS NOT NULL AND dispatched_at < ?", cutoff); err != nil {
+		log.Printf("Failed to prune scheduled jobs: %v", err)
+	}
+}
+
+// Backlog reports how many of user's jobs are waiting and in flight.
+func (s *fairScheduler) Backlog(ctx context.Context, user string) (userBacklog, error) {
+	backlog := userBacklog{MaxInFlight: s.maxInFlight}
+
+	err := s.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM scheduled_jobs WHERE user_id = ? AND dispatched_at IS NULL AND failed_at IS NULL", user,
+	).Scan(&backlog.Waiting)
+	if err != nil {
+		return backlog, err
+	}
+
+	inFlight, err := s.inFlight(ctx)
+	if err != nil {
+		return backlog, err
+	}
+	backlog.InFlight = inFlight[user]
+	return backlog, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JerryG0311/Vidify/internal/pubsub"
+	"github.com/JerryG0311/Vidify/internal/routing"
+)
+
+// openTestDB returns an in-memory database with the migrations the
+// schedulers and the events consumer touch applied from sql/schema.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	for _, name := range []string{
+		"20260307222009_init.sql",
+		"20260322000100_create_outbox.sql",
+		"20260322000200_add_priority_to_outbox.sql",
+		"20260322000400_create_scheduled_jobs.sql",
+		"20260322000500_create_delayed_jobs.sql",
+		"20260322000600_add_progress_to_videos.sql",
+		"20260322000700_create_workflow_runs.sql",
+		"20260322000800_add_failed_at_to_outbox.sql",
+		"20260322000900_add_failed_at_to_backlogs.sql",
+	} {
+		migration, err := os.ReadFile(filepath.Join("..", "..", "sql", "schema", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		up, _, _ := strings.Cut(string(migration), "-- +goose Down")
+		if _, err := db.Exec(up); err != nil {
+			t.Fatalf("apply %s: %v", name, err)
+		}
+	}
+	return db
+}
+
+// submit adds a PENDING video and its job to the backlog.
+func submit(t *testing.T, db *sql.DB, scheduler *fairScheduler, user, id string, priority uint8) {
+	t.Helper()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO videos (id, user_id, status) VALUES (?, ?, 'PENDING')", id, user); err != nil {
+		t.Fatal(err)
+	}
+	job := routing.VideoJob{ID: id, UserID: user, TargetFormat: routing.FormatMP4, Priority: priority}
+	if err := scheduler.Submit(tx, job, pubsub.Envelope{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJobsWithoutALivePipelineFreeTheirSlot(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	scheduler := newFairScheduler(db, pubsub.NewOutbox(db), 3)
+
+	for _, id := range []string{"vid-lost", "vid-running", "vid-stuck", "vid-new"} {
+		submit(t, db, scheduler, "a@example.com", id, routing.PriorityNormal)
+	}
+	if err := scheduler.dispatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// vid-lost was dispatched long ago and never started a run, as if its job was dead-lettered;
+	// vid-stuck started one whose step has not been heard from since
+	longAgo := time.Now().UTC().Add(-2 * jobStartGrace)
+	if _, err := db.Exec("UPDATE scheduled_jobs SET dispatched_at = ? WHERE job_id != 'vid-new'", longAgo); err != nil {
+		t.Fatal(err)
+	}
+	for _, run := range []struct {
+		id, video string
+		queuedAt  time.Time
+	}{
+		{"run-1", "vid-running", time.Now().UTC()},
+		{"run-2", "vid-stuck", time.Now().UTC().Add(-staleStepAfter - time.Minute)},
+	} {
+		if _, err := db.Exec("INSERT INTO workflow_runs (id, video_id, user_id, pipeline, source_path, status, started_at) VALUES (?, ?, 'a@example.com', 'mp4', '', 'RUNNING', ?)", run.id, run.video, longAgo); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO workflow_steps (run_id, name, kind, status, queued_at) VALUES (?, 'transcode', 'transcode', 'QUEUED', ?)", run.id, run.queuedAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inFlight, err := scheduler.inFlight(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inFlight["a@example.com"] != 1 {
+		t.Fatalf("expected only the job with a live pipeline in flight, got %d", inFlight["a@example.com"])
+	}
+
+	if err := scheduler.dispatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var waiting int
+	if err := db.QueryRow("SELECT COUNT(*) FROM scheduled_jobs WHERE dispatched_at IS NULL").Scan(&waiting); err != nil {
+		t.Fatal(err)
+	}
+	if waiting != 0 {
+		t.Fatalf("expected the freed slot to release the last job, %d still waiting", waiting)
+	}
+}
+
+func TestUndecodableJobIsParked(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	scheduler := newFairScheduler(db, pubsub.NewOutbox(db), 1)
+
+	submit(t, db, scheduler, "a@example.com", "vid-bad", routing.PriorityNormal)
+	submit(t, db, scheduler, "a@example.com", "vid-good", routing.PriorityNormal)
+	if _, err := db.Exec("UPDATE scheduled_jobs SET body = '{' WHERE job_id = 'vid-bad'"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bad row neither stops the pass nor takes the user's only slot
+	if err := scheduler.dispatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var parked, dispatched int
+	if err := db.QueryRow("SELECT COUNT(*) FROM scheduled_jobs WHERE job_id = 'vid-bad' AND failed_at IS NOT NULL AND last_error != ''").Scan(&parked); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM scheduled_jobs WHERE job_id = 'vid-good' AND dispatched_at IS NOT NULL").Scan(&dispatched); err != nil {
+		t.Fatal(err)
+	}
+	if parked != 1 || dispatched != 1 {
+		t.Fatalf("expected vid-bad parked and vid-good dispatched, got %d parked and %d dispatched", parked, dispatched)
+	}
+
+	var status string
+	if err := db.QueryRow("SELECT status FROM videos WHERE id = 'vid-bad'").Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status != "FAILED" {
+		t.Fatalf("expected the parked job's video FAILED, got %s", status)
+	}
+	backlog, err := scheduler.Backlog(ctx, "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backlog.Waiting != 0 {
+		t.Fatalf("expected the parked job not to count as waiting, got %+v", backlog)
+	}
+}
+
+func TestUsersTakeTurnsInTheOrderTheyStartedWaiting(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	scheduler := newFairScheduler(db, pubsub.NewOutbox(db), 2)
+
+	// b waited first; a's urgent backlog must not put a ahead of b
+	submit(t, db, scheduler, "b@example.com", "b-1", routing.PriorityNormal)
+	submit(t, db, scheduler, "b@example.com", "b-2", routing.PriorityNormal)
+	submit(t, db, scheduler, "a@example.com", "a-1", routing.PriorityHigh)
+	submit(t, db, scheduler, "a@example.com", "a-2", routing.PriorityHigh)
+	submit(t, db, scheduler, "a@example.com", "a-3", routing.PriorityHigh)
+	submit(t, db, scheduler, "c@example.com", "c-1", routing.PriorityNormal)
+
+	if err := scheduler.dispatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query("SELECT body FROM outbox ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var order []string
+	for rows.Next() {
+		var body []byte
+		if err := rows.Scan(&body); err != nil {
+			t.Fatal(err)
+		}
+		var job routing.VideoJob
+		if err := json.Unmarshal(body, &job); err != nil {
+			t.Fatal(err)
+		}
+		order = append(order, job.ID)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"b-1", "a-1", "c-1", "b-2", "a-2"}
+	if strings.Join(order, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected jobs dispatched as %v, got %v", want, order)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/JerryG0311/Vidify/internal/pubsub"
+	"github.com/JerryG0311/Vidify/internal/routing"
+	"github.com/JerryG0311/Vidify/internal/workflow"
+)
+
+const (
+	// staleStepAfter is how long a queued step may go without a result, or a
+	// retry, before its run is failed. It covers the wait in a long step queue
+	// as well as the longest transcode.
+	staleStepAfter = 6 * time.Hour
+	// staleSweepInterval is how often runs are checked for silent steps.
+	staleSweepInterval = time.Minute
+)
+
+// workflows turns the jobs released by the schedulers into pipeline runs and
+// moves each run along as the workers report its steps. The steps' own
+// events still drive the video's status through videoEvents.
+type workflows struct {
+	db        *sql.DB
+	engine    *workflow.Engine
+	outbox    *pubsub.Outbox
+	scheduler *fairScheduler
+}
+
+func (w *workflows) HandleJob(job routing.VideoJob, env pubsub.Envelope) pubsub.AckType {
+	// The steps carry the job's correlation and trace
+	ctx := pubsub.ContextWithEnvelope(context.Background(), env)
+
+	if _, err := routing.PipelineFor(job.TargetFormat); err != nil {
+		log.Printf("Cannot process video %s: %v (correlation=%s)", job.ID, err, env.CorrelationID)
+		if _, err := w.db.ExecContext(ctx, "UPDATE videos SET status = 'FAILED', last_error = ? WHERE id = ?", err.Error(), job.ID); err != nil {
+			log.Printf("Failed to mark video %s failed: %v", job.ID, err)
+		}
+		w.scheduler.Notify()
+		env.RecordError(err)
+		return pubsub.NackDiscard
+	}
+
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		env.RecordError(err)
+		return pubsub.NackRequeue
+	}
+	defer tx.Rollback()
+
+	started, err := w.engine.Start(ctx, tx, env.MessageID, job)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to start pipeline for video %s: %v", job.ID, err)
+		env.RecordError(err)
+		return pubsub.NackRequeue
+	}
+
+	if started {
+		w.outbox.Notify()
+		log.Printf("Started %s pipeline run %s for video %s (correlation=%s)", job.TargetFormat, env.MessageID, job.ID, env.CorrelationID)
+	}
+	return pubsub.Ack
+}
+
+func (w *workflows) HandleResult(result routing.StepResult, env pubsub.Envelope) pubsub.AckType {
+	ctx := pubsub.ContextWithEnvelope(context.Background(), env)
+
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		env.RecordError(err)
+		return pubsub.NackRequeue
+	}
+	defer tx.Rollback()
+
+	run, err := w.engine.Record(ctx, tx, result)
+	if errors.Is(err, workflow.ErrUnknownRun) {
+		// The video was deleted while the step ran
+		log.Printf("Ignoring %s result for run %s: %v", result.Step, result.RunID, err)
+		return pubsub.Ack
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to record %s result for run %s: %v", result.Step, result.RunID, err)
+		env.RecordError(err)
+		return pubsub.NackRequeue
+	}
+
+	w.outbox.Notify()
+	if result.Error != "" && !result.Retrying && run.Status == workflow.RunFailed {
+		log.Printf("Pipeline run %s for video %s failed: %s (correlation=%s)", run.ID, run.VideoID, run.Error, env.CorrelationID)
+	} else if result.Error == "" && run.Status == workflow.RunCompleted {
+		log.Printf("Pipeline run %s for video %s completed (correlation=%s)", run.ID, run.VideoID, env.CorrelationID)
+	}
+	return pubsub.Ack
+}
+
+// Sweep fails runs stuck on a step no worker reports on until ctx is
+// cancelled. A step that was dead-lettered, or dropped by the broker after
+// crashing workers too often, would otherwise keep its run and video going
+// forever.
+func (w *workflows) Sweep(ctx context.Context) {
+	ticker := time.NewTicker(staleSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.failStale(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Stale run sweep: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *workflows) failStale(ctx context.Context) error {
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	runs, err := w.engine.FailStale(ctx, tx, time.Now().UTC().Add(-staleStepAfter))
+	if err != nil {
+		return err
+	}
+	for _, run := range runs {
+		_, err := tx.ExecContext(ctx,
+			"UPDATE videos SET status = 'FAILED', last_error = ? WHERE id = ? AND status != 'COMPLETED'",
+			run.Error, run.VideoID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, run := range runs {
+		log.Printf("Pipeline run %s for video %s failed: %s", run.ID, run.VideoID, run.Error)
+	}
+	if len(runs) > 0 {
+		// Their users may have jobs waiting for these slots
+		w.scheduler.Notify()
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/JerryG0311/Vidify/internal/pubsub"
+	"github.com/JerryG0311/Vidify/internal/routing"
+	"github.com/JerryG0311/Vidify/internal/workflow"
+)
+
+func TestSweepFailsRunsWithALostStep(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	outbox := pubsub.NewOutbox(db)
+	flows := &workflows{db: db, engine: workflow.NewEngine(db), outbox: outbox, scheduler: newFairScheduler(db, outbox, 2)}
+
+	if _, err := db.Exec("INSERT INTO videos (id, user_id, status) VALUES ('vid-1', 'a@example.com', 'PROCESSING')"); err != nil {
+		t.Fatal(err)
+	}
+	job := routing.VideoJob{ID: "vid-1", UserID: "a@example.com", TargetFormat: routing.FormatMP4}
+	if ack := flows.HandleJob(job, pubsub.Envelope{MessageID: "run-1"}); ack != pubsub.Ack {
+		t.Fatalf("expected the job to start a run, got %v", ack)
+	}
+
+	// The probe was dead-lettered and no worker will ever report on it
+	if _, err := db.Exec("UPDATE workflow_steps SET queued_at = ?", time.Now().UTC().Add(-staleStepAfter-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := flows.failStale(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var status, lastError string
+	if err := db.QueryRow("SELECT status, last_error FROM videos WHERE id = 'vid-1'").Scan(&status, &lastError); err != nil {
+		t.Fatal(err)
+	}
+	if status != "FAILED" || lastError == "" {
+		t.Fatalf("expected the video FAILED with the run's error, got %s %q", status, lastError)
+	}
+	select {
+	case <-flows.scheduler.wake:
+	default:
+		t.Fatal("expected the scheduler to be woken for the freed slot")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/JerryG0311/Vidify/internal/routing"
+)
+
+// cancelRegistry tracks the jobs this worker is running and the videos that
+// were cancelled. Cancelling a running job cancels its context, which kills
+// its ffmpeg; a job for a cancelled video is skipped when it arrives.
+type cancelRegistry struct {
+	mu        sync.Mutex
+	cancelled map[string]time.Time                     // video ID -> when it was cancelled
+	running   map[string]map[uint64]context.CancelFunc // video ID -> running jobs
+	seq       uint64
+}
+
+func newCancelRegistry() *cancelRegistry {
+	return &cancelRegistry{
+		cancelled: map[string]time.Time{},
+		running:   map[string]map[uint64]context.CancelFunc{},
+	}
+}
+
+// Start registers a job for videoID. The context, derived from parent, is
+// also cancelled if the video is, and finish must be called when the job
+// ends. skip is true if the video was cancelled before the job arrived.
+func (r *cancelRegistry) Start(parent context.Context, videoID string) (ctx context.Context, finish func(), skip bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.cancelled[videoID]; ok {
+		return context.Background(), func() {}, true
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	r.seq++
+	id := r.seq
+	if r.running[videoID] == nil {
+		r.running[videoID] = map[uint64]context.CancelFunc{}
+	}
+	r.running[videoID][id] = cancel
+
+	return ctx, func() {
+		r.mu.Lock()
+		delete(r.running[videoID], id)
+		if len(r.running[videoID]) == 0 {
+			delete(r.running, videoID)
+		}
+		r.mu.Unlock()
+		cancel()
+	}, false
+}
+
+// Cancel remembers videoID as cancelled and stops its running jobs,
+// returning how many there were. Cancellations older than
+// routing.VideoCancelMaxAge are forgotten, like the stream they came from.
+func (r *cancelRegistry) Cancel(videoID string, at time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, cancelledAt := range r.cancelled {
+		if time.Since(cancelledAt) > routing.VideoCancelMaxAge {
+			delete(r.cancelled, id)
+		}
+	}
+	r.cancelled[videoID] = at
+
+	for _, cancel := range r.running[videoID] {
+		cancel()
+	}
+	return len(r.running[videoID])
+}
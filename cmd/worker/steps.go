@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JerryG0311/Vidify/internal/pubsub"
+	"github.com/JerryG0311/Vidify/internal/routing"
+	"github.com/JerryG0311/Vidify/internal/storage"
+	"github.com/JerryG0311/Vidify/internal/workflow"
+)
+
+// hlsSegmentSeconds is the target length of an HLS segment.
+const hlsSegmentSeconds = 6
+
+// stepFunc runs one kind of step in dir, a scratch directory removed
+// afterwards, and returns the outputs passed on to the steps that need it.
+// ctx carries the step's envelope and is cancelled with its video.
+type stepFunc func(ctx context.Context, task routing.StepTask, dir string, stepLog *log.Logger) (map[string]string, error)
+
+var stepFuncs = map[string]stepFunc{
+	routing.StepProbe:     runProbe,
+	routing.StepThumbnail: runThumbnail,
+	routing.StepTranscode: runTranscode,
+	routing.StepPackage:   runPackage,
+	routing.StepPublish:   runPublish,
+}
+
+// permanentError is a failure that trying again cannot fix, such as ffmpeg
+// rejecting the upload. The step fails without using its retries.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// handlerStep runs one step of a pipeline run and reports its outputs to the
+// API, which queues the steps that were waiting for it.
+func handlerStep(task routing.StepTask, env pubsub.Envelope) pubsub.AckType {
+	// Every line for this step carries the correlation and trace IDs from the upload request
+	stepLog := log.New(os.Stderr, fmt.Sprintf("[%s %s correlation=%s trace=%s] ", task.VideoID, task.Step, env.CorrelationID, env.TraceID()), log.LstdFlags|log.Lmsgprefix)
+	stepLog.Printf("Worker received %s step of run %s (sent %s, priority %d)", task.Kind, task.RunID, env.Timestamp.Format(time.RFC3339), task.Priority)
+
+	run, ok := stepFuncs[task.Kind]
+	if !ok {
+		env.RecordError(fmt.Errorf("unknown step kind %q", task.Kind))
+		return pubsub.NackDiscard
+	}
+
+	// jobCtx is cancelled, killing ffmpeg, if a video.cancel for this video arrives
+	// or the step runs past WORKER_JOB_TIMEOUT
+	jobCtx, finish, skip := cancels.Start(env.Context(), task.VideoID)
+	defer finish()
+	if skip {
+		stepLog.Printf("Video %s was cancelled before this step arrived, skipping it", task.VideoID)
+		return pubsub.Ack
+	}
+
+	dir, err := os.MkdirTemp("", fmt.Sprintf("%s-%s-", task.VideoID, task.Step))
+	if err != nil {
+		env.RecordError(fmt.Errorf("scratch directory: %w", err))
+		return pubsub.NackRetry
+	}
+	defer os.RemoveAll(dir)
+
+	// The first steps of a run are where processing starts
+	if len(task.Needs) == 0 {
+		if err := publishEvent(env, routing.VideoEvent{VideoID: task.VideoID, Kind: routing.EventProcessing}); err != nil {
+			stepLog.Printf("Failed to report processing of video %s: %v", task.VideoID, err)
+		}
+	}
+
+	outputs, err := run(pubsub.ContextWithEnvelope(jobCtx, env), task, dir, stepLog)
+	if jobCtx.Err() != nil && env.Context().Err() == nil {
+		stepLog.Printf("Video %s was cancelled, stopping step %s", task.VideoID, task.Step)
+		return pubsub.Ack
+	}
+	if err != nil {
+		stepLog.Printf("Step %s failed: %v", task.Step, err)
+		env.RecordError(err)
+		if errors.As(err, new(permanentError)) {
+			return pubsub.NackDiscard
+		}
+		return pubsub.NackRetry
+	}
+
+	if task.Kind != routing.StepPublish {
+		reportProgress(stepLog, task, env)
+	}
+
+	// The run only moves on once the API has this result, so retry until it is sent
+	result := routing.StepResult{RunID: task.RunID, Step: task.Step, WorkerID: workerID, Outputs: outputs}
+	if err := publishStepResult(env, result); err != nil {
+		stepLog.Printf("Failed to report result of step %s: %v", task.Step, err)
+		env.RecordError(fmt.Errorf("report result: %w", err))
+		return pubsub.NackRetry
+	}
+	return pubsub.Ack
+}
+
+// runProbe checks the upload is a readable video and reads its duration.
+func runProbe(ctx context.Context, task routing.StepTask, dir string, _ *log.Logger) (map[string]string, error) {
+	input, err := downloadTo(task.SourcePath, dir, "source.mp4")
+	if err != nil {
+		return nil, err
+	}
+
+	duration, err := probeDuration(ctx, input)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("probe: %w", err))
+	}
+	return map[string]string{"duration_seconds": strconv.FormatFloat(duration, 'f', -1, 64)}, nil
+}
+
+// runThumbnail grabs a frame one second in. A clip too short for that just
+// has no thumbnail.
+func runThumbnail(ctx context.Context, task routing.StepTask, dir string, stepLog *log.Logger) (map[string]string, error) {
+	input, err := downloadTo(task.SourcePath, dir, "source.mp4")
+	if err != nil {
+		return nil, err
+	}
+
+	thumbLocal := filepath.Join(dir, "thumb.jpg")
+	thumbCmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-i", input, "-ss", "00:00:01.000", "-vframes", "1", thumbLocal)
+	if output, err := thumbCmd.CombinedOutput(); err != nil {
+		stepLog.Printf("Thumbnail generation failed for video %s: %v | ffmpeg output: %s", task.VideoID, err, string(output))
+		return map[string]string{}, nil
+	}
+	if info, err := os.Stat(thumbLocal); err != nil || info.Size() == 0 {
+		stepLog.Printf("Thumbnail file was missing or empty for video %s", task.VideoID)
+		return map[string]string{}, nil
+	}
+
+	thumbKey := fmt.Sprintf("%s_thumb.jpg", task.VideoID)
+	thumbURL, err := storage.UploadFileToS3(thumbKey, thumbLocal)
+	if err != nil {
+		return nil, fmt.Errorf("upload thumbnail: %w", err)
+	}
+	return map[string]string{"thumbnail_url": thumbURL, workflow.ArtifactsOutput: thumbKey}, nil
+}
+
+// runTranscode encodes one rendition, scaled to the height param if it has
+// one, and uploads it as <video>_<rendition>.mp4.
+func runTranscode(ctx context.Context, task routing.StepTask, dir string, stepLog *log.Logger) (map[string]string, error) {
+	input, err := downloadTo(task.SourcePath, dir, "source.mp4")
+	if err != nil {
+		return nil, err
+	}
+
+	rendition := task.Params["rendition"]
+	height := task.Params["height"]
+	outputLocal := filepath.Join(dir, rendition+".mp4")
+	args := []string{"-y", "-i", input}
+	if height != "" {
+		args = append(args, "-vf", "scale=-2:"+height)
+	}
+	args = append(args, outputLocal)
+
+	transcodeOutput, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput()
+	if err != nil {
+		if ctx.Err() == nil {
+			stepLog.Printf("Transcode failed for video %s: %v | ffmpeg output: %s", task.VideoID, err, string(transcodeOutput))
+		}
+		return nil, permanent(fmt.Errorf("transcode %s: %w: %s", rendition, err, lastLine(transcodeOutput)))
+	}
+
+	key := fmt.Sprintf("%s_%s.mp4", task.VideoID, rendition)
+	url, err := storage.UploadFileToS3(key, outputLocal)
+	if err != nil {
+		return nil, fmt.Errorf("upload %s: %w", rendition, err)
+	}
+	return map[string]string{"url": url, "rendition": rendition, "height": height, workflow.ArtifactsOutput: key}, nil
+}
+
+// runPackage cuts every rendition it needs into HLS segments and uploads them
+// with a master playlist under <video>_hls/.
+func runPackage(ctx context.Context, task routing.StepTask, dir string, stepLog *log.Logger) (map[string]string, error) {
+	hlsDir := filepath.Join(dir, "hls")
+	if err := os.Mkdir(hlsDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	master := []string{"#EXTM3U", "#EXT-X-VERSION:3"}
+	for _, need := range task.Needs {
+		rendition := task.Input(need, "rendition")
+		input, err := downloadTo(task.Input(need, "url"), dir, rendition+".mp4")
+		if err != nil {
+			return nil, err
+		}
+
+		segments := filepath.Join(hlsDir, rendition+"_%03d.ts")
+		playlist := filepath.Join(hlsDir, rendition+".m3u8")
+		packageCmd := exec.CommandContext(ctx, "ffmpeg", "-y", "-i", input, "-c", "copy",
+			"-hls_time", strconv.Itoa(hlsSegmentSeconds), "-hls_playlist_type", "vod",
+			"-hls_segment_filename", segments, playlist)
+		if output, err := packageCmd.CombinedOutput(); err != nil {
+			if ctx.Err() == nil {
+				stepLog.Printf("Packaging %s failed for video %s: %v | ffmpeg output: %s", rendition, task.VideoID, err, string(output))
+			}
+			return nil, permanent(fmt.Errorf("package %s: %w: %s", rendition, err, lastLine(output)))
+		}
+
+		master = append(master, fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d", bandwidth(ctx, input)), rendition+".m3u8")
+	}
+	if err := os.WriteFile(filepath.Join(hlsDir, "master.m3u8"), []byte(strings.Join(master, "\n")+"\n"), 0o644); err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(hlsDir)
+	if err != nil {
+		return nil, err
+	}
+	prefix := task.VideoID + "_hls/"
+	var keys []string
+	var playlistURL string
+	for _, file := range files {
+		key := prefix + file.Name()
+		url, err := storage.UploadFileToS3(key, filepath.Join(hlsDir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("upload %s: %w", file.Name(), err)
+		}
+		if file.Name() == "master.m3u8" {
+			playlistURL = url
+		}
+		keys = append(keys, key)
+	}
+	return map[string]string{"playlist_url": playlistURL, workflow.ArtifactsOutput: strings.Join(keys, ",")}, nil
+}
+
+// runPublish hands the finished video to the API with the completed event,
+// built from the outputs of the steps it needs.
+func runPublish(ctx context.Context, task routing.StepTask, _ string, stepLog *log.Logger) (map[string]string, error) {
+	event := routing.VideoEvent{
+		VideoID:           task.VideoID,
+		Kind:              routing.EventCompleted,
+		ProcessedURL:      task.Input(task.Params["video"], "url"),
+		ProcessingSeconds: time.Since(task.StartedAt).Seconds(),
+	}
+	for _, need := range task.Needs {
+		if url := task.Input(need, "thumbnail_url"); url != "" {
+			event.ThumbnailURL = url
+		}
+		if raw := task.Input(need, "duration_seconds"); raw != "" {
+			event.DurationSeconds, _ = strconv.ParseFloat(raw, 64)
+		}
+		if url := task.Input(need, "playlist_url"); url != "" {
+			stepLog.Printf("HLS playlist for video %s: %s", task.VideoID, url)
+		}
+	}
+	if event.ProcessedURL == "" {
+		return nil, permanent(fmt.Errorf("publish: step %q produced no video", task.Params["video"]))
+	}
+
+	env, _ := pubsub.EnvelopeFromContext(ctx)
+	if err := publishEvent(env, event); err != nil {
+		return nil, fmt.Errorf("report completion: %w", err)
+	}
+	return map[string]string{}, nil
+}
+
+func downloadTo(url, dir, name string) (string, error) {
+	local := filepath.Join(dir, name)
+	if err := storage.DownloadFromS3(url, local); err != nil {
+		return "", fmt.Errorf("download: %w", err)
+	}
+	return local, nil
+}
+
+// bandwidth estimates a rendition's average bit rate for the master
+// playlist from its size and duration.
+func bandwidth(ctx context.Context, path string) int {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	duration, err := probeDuration(ctx, path)
+	if err != nil || duration <= 0 {
+		return 0
+	}
+	return int(float64(info.Size()*8) / duration)
+}
+
+// reportFailures reports every failed step to the API: as failed for good
+// when it is dead-lettered, whether the handler gave up, panicked, timed out
+// or used its last retry, and as retrying otherwise. A failed event goes out
+// too, so the video shows the error.
+func reportFailures(maxAttempts int) pubsub.Middleware[routing.StepTask] {
+	return func(next pubsub.Handler[routing.StepTask]) pubsub.Handler[routing.StepTask] {
+		return func(task routing.StepTask, env pubsub.Envelope) pubsub.AckType {
+			ackType := next(task, env)
+			if ackType != pubsub.NackDiscard && ackType != pubsub.NackRetry {
+				return ackType
+			}
+
+			retrying := ackType == pubsub.NackRetry && env.RetryAttempt() < maxAttempts
+			message := "step failed"
+			if err := env.RecordedError(); err != nil {
+				message = err.Error()
+			}
+
+			result := routing.StepResult{RunID: task.RunID, Step: task.Step, WorkerID: workerID, Error: message, Retrying: retrying}
+			if err := publishStepResult(env, result); err != nil {
+				log.Printf("Failed to report failure of step %s of run %s: %v", task.Step, task.RunID, err)
+			}
+			event := routing.VideoEvent{VideoID: task.VideoID, Kind: routing.EventFailed, Error: task.Step + ": " + message, Retrying: retrying}
+			if err := publishEvent(env, event); err != nil {
+				log.Printf("Failed to report failure of video %s: %v", task.VideoID, err)
+			}
+			return ackType
+		}
+	}
+}
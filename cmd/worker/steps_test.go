@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/JerryG0311/Vidify/internal/pubsub"
+	"github.com/JerryG0311/Vidify/internal/routing"
+)
+
+// startWorker points the worker's globals at a MemoryBroker and an in-memory
+// ledger and subscribes handlerStep to the publish steps like main does.
+func startWorker(t *testing.T) *pubsub.MemoryBroker {
+	t.Helper()
+
+	memory := pubsub.NewMemoryBroker()
+	if err := pubsub.ApplyTopology(memory, routing.VideoTopology); err != nil {
+		t.Fatal(err)
+	}
+	ledgerDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledgerDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { ledgerDB.Close() })
+
+	broker, ledger, workerID = memory, pubsub.NewLedger(ledgerDB), "worker-test"
+	if err := ledger.EnsureTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	_, err = pubsub.SubscribeEnvelope(ctx, broker, routing.ExchangeVideoTopic, routing.StepQueue(routing.StepPublish), routing.StepKey(routing.StepPublish),
+		pubsub.SimpleQueueQuorum, pubsub.JSON, handlerStep, stepOptions(1, 1, 1)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return memory
+}
+
+// next waits for a message on queue and decodes it into val.
+func next(t *testing.T, memory *pubsub.MemoryBroker, queue string, val any) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for memory.QueueLen(queue) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for a message on %s", queue)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	msg, _ := memory.Get(queue)
+	if err := json.Unmarshal(msg.Body, val); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func publishTask(t *testing.T, task routing.StepTask) {
+	t.Helper()
+
+	if err := pubsub.Publish(context.Background(), broker, pubsub.JSON, routing.ExchangeVideoTopic, routing.StepKey(task.Kind), task); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPublishStepCompletesTheVideo(t *testing.T) {
+	memory := startWorker(t)
+
+	publishTask(t, routing.StepTask{
+		RunID:   "run-1",
+		VideoID: "vid-1",
+		Step:    "publish",
+		Kind:    routing.StepPublish,
+		Needs:   []string{"probe", "transcode"},
+		Params:  map[string]string{"video": "transcode"},
+		Inputs: map[string]string{
+			"probe.duration_seconds": "12.5",
+			"transcode.url":          "https://bucket/vid-1_processed.mp4",
+		},
+	})
+
+	var event routing.VideoEvent
+	next(t, memory, routing.VideoStatusQueue, &event)
+	if event.Kind != routing.EventCompleted || event.ProcessedURL != "https://bucket/vid-1_processed.mp4" || event.DurationSeconds != 12.5 {
+		t.Fatalf("expected a completed event with the transcode's video, got %+v", event)
+	}
+
+	var result routing.StepResult
+	next(t, memory, routing.StepResultQueue, &result)
+	if result.RunID != "run-1" || result.Step != "publish" || result.Error != "" || result.WorkerID != "worker-test" {
+		t.Fatalf("expected the step reported done, got %+v", result)
+	}
+}
+
+func TestFailedStepIsReportedAndDeadLettered(t *testing.T) {
+	memory := startWorker(t)
+
+	// Nothing produced a video, which no retry can fix
+	publishTask(t, routing.StepTask{RunID: "run-1", VideoID: "vid-1", Step: "publish", Kind: routing.StepPublish, Needs: []string{"transcode"}, Params: map[string]string{"video": "transcode"}})
+
+	var result routing.StepResult
+	next(t, memory, routing.StepResultQueue, &result)
+	if result.Error == "" || result.Retrying {
+		t.Fatalf("expected the step reported failed for good, got %+v", result)
+	}
+
+	var event routing.VideoEvent
+	next(t, memory, routing.VideoStatusQueue, &event)
+	if event.Kind != routing.EventFailed || event.Retrying {
+		t.Fatalf("expected a failed event, got %+v", event)
+	}
+
+	var task routing.StepTask
+	next(t, memory, routing.VideoDLQueue, &task)
+	if task.RunID != "run-1" {
+		t.Fatalf("expected the step in the failed queue, got %+v", task)
+	}
+}
@@ -0,0 +1,53 @@
+package pubsub
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Broker is what publishers and subscribers need from a message broker.
+// *Connection talks to RabbitMQ; MemoryBroker runs in-process for tests.
+//
+// Deliveries returned by Consume are acked through their own Acknowledger,
+// exactly like deliveries from an AMQP channel.
+type Broker interface {
+	ExchangeDeclare(name, kind string) error
+	QueueDeclare(name string, simpleQueueType SimpleQueueType, args amqp.Table) error
+	QueueBind(queueName, key, exchange string) error
+
+	// Publish blocks until the broker has accepted the message and returns
+	// ErrUnroutable if no queue was bound for it.
+	Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error
+
+	// Consume delivers messages from queueName until ctx is cancelled, then
+	// cancels the consumer and closes the returned channel.
+	Consume(ctx context.Context, queueName, consumerTag string, prefetch int) (<-chan amqp.Delivery, error)
+}
+
+func queueFlags(simpleQueueType SimpleQueueType) (durable, autoDelete, exclusive bool) {
+	durable = simpleQueueType != SimpleQueueTransient
+	autoDelete = simpleQueueType == SimpleQueueTransient
+	exclusive = simpleQueueType == SimpleQueueTransient
+	return durable, autoDelete, exclusive
+}
+
+// declareArgs adds the x-queue-type that quorum and stream queues are
+// declared with, without touching the caller's table.
+func declareArgs(simpleQueueType SimpleQueueType, args amqp.Table) amqp.Table {
+	var queueType string
+	switch simpleQueueType {
+	case SimpleQueueQuorum:
+		queueType = "quorum"
+	case SimpleQueueStream:
+		queueType = "stream"
+	default:
+		return args
+	}
+
+	declared := amqp.Table{"x-queue-type": queueType}
+	for k, v := range args {
+		declared[k] = v
+	}
+	return declared
+}
@@ -0,0 +1,132 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec turns values into message bodies and back. The content type is put on
+// every publish so subscribers can pick the matching codec per delivery.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	JSON     Codec = jsonCodec{}
+	Gob      Codec = gobCodec{}
+	MsgPack  Codec = msgpackCodec{}
+	Protobuf Codec = protobufCodec{}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		"application/json":       JSON,
+		"application/gob":        Gob,
+		"application/msgpack":    MsgPack,
+		"application/x-msgpack":  MsgPack,
+		"application/x-protobuf": Protobuf,
+		"application/protobuf":   Protobuf,
+	}
+)
+
+// RegisterCodec makes c available to subscribers under its content type.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.ContentType()] = c
+}
+
+// codecFor picks the decoder for a delivery, falling back to the
+// subscriber's codec when the producer did not set a content type.
+func codecFor(contentType string, fallback Codec) (Codec, error) {
+	// Drop parameters such as "; charset=utf-8"
+	contentType = strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	if contentType == "" {
+		return fallback, nil
+	}
+
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	codec, ok := codecs[contentType]
+	if !ok {
+		return nil, fmt.Errorf("pubsub: no codec registered for content type %q", contentType)
+	}
+	return codec, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string                { return "application/json" }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return "application/gob" }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string                { return "application/msgpack" }
+func (msgpackCodec) Marshal(v any) ([]byte, error)      { return msgpack.Marshal(v) }
+func (msgpackCodec) Unmarshal(data []byte, v any) error { return msgpack.Unmarshal(data, v) }
+
+// protobufCodec only works for generated message types, e.g. Subscribe[*pb.VideoJob].
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string { return "application/x-protobuf" }
+
+func (protobufCodec) Marshal(v any) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("pubsub: %T is not a protobuf message", v)
+	}
+	return proto.Marshal(msg)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v any) error {
+	if msg, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, msg)
+	}
+
+	// Subscribers decode into *T where T is itself a pointer like *pb.VideoJob,
+	// so allocate the message before unmarshalling into it
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() != reflect.Pointer || ptr.IsNil() || ptr.Elem().Kind() != reflect.Pointer {
+		return fmt.Errorf("pubsub: %T is not a protobuf message", v)
+	}
+
+	elem := reflect.New(ptr.Elem().Type().Elem())
+	msg, ok := elem.Interface().(proto.Message)
+	if !ok {
+		return fmt.Errorf("pubsub: %T is not a protobuf message", v)
+	}
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return err
+	}
+	ptr.Elem().Set(elem)
+	return nil
+}
@@ -0,0 +1,302 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	dialAttempts = 8
+	backoffBase  = 500 * time.Millisecond
+	backoffMax   = 30 * time.Second
+)
+
+var ErrConnectionClosed = errors.New("pubsub: connection closed")
+
+// Connection wraps an AMQP connection that redials itself when the broker
+// goes away. Everything declared through it (or registered with OnConnect)
+// is re-declared on every reconnect, and subscriptions and publishers pick
+// up the new connection. It is the RabbitMQ implementation of Broker.
+type Connection struct {
+	url string
+
+	mu    sync.Mutex
+	conn  *amqp.Connection
+	ready chan struct{} // closed while conn is usable
+	setup []setupStep
+
+	pubMu     sync.Mutex
+	publisher *Publisher
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// setupStep is a declaration replayed after a reconnect. Steps with the
+// same id replace each other so re-declaring a queue does not pile up.
+type setupStep struct {
+	id string
+	fn func(*amqp.Channel) error
+}
+
+func Dial(url string) (*Connection, error) {
+	c := &Connection{
+		url:   url,
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	var conn *amqp.Connection
+	var err error
+	for attempt := 0; attempt < dialAttempts; attempt++ {
+		log.Printf("Connecting to RabbitMQ (attempt %d)...", attempt+1)
+		conn, err = amqp.Dial(url)
+		if err == nil || attempt == dialAttempts-1 {
+			break
+		}
+		wait := backoff(attempt)
+		log.Printf("RabbitMQ dial failed: %v. Retrying in %s", err, wait)
+		time.Sleep(wait)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("Connected to RabbitMQ")
+	c.setConn(conn)
+	go c.watch(conn)
+
+	return c, nil
+}
+
+// OnConnect runs fn against the current connection and again after every
+// reconnect, before subscribers and publishers are allowed to use it.
+func (c *Connection) OnConnect(fn func(*amqp.Channel) error) error {
+	return c.declare("", fn)
+}
+
+func (c *Connection) declare(id string, fn func(*amqp.Channel) error) error {
+	conn, err := c.awaitConn(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if err := runSetup(conn, setupStep{id: id, fn: fn}); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id != "" {
+		for i, step := range c.setup {
+			if step.id == id {
+				c.setup[i].fn = fn
+				return nil
+			}
+		}
+	}
+	c.setup = append(c.setup, setupStep{id: id, fn: fn})
+	return nil
+}
+
+// Channel opens a new channel on the live connection, waiting for a
+// reconnect if the broker is currently unreachable.
+func (c *Connection) Channel(ctx context.Context) (*amqp.Channel, error) {
+	conn, err := c.awaitConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Channel()
+}
+
+func (c *Connection) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		c.pubMu.Lock()
+		if c.publisher != nil {
+			c.publisher.Close()
+		}
+		c.pubMu.Unlock()
+
+		c.mu.Lock()
+		conn := c.conn
+		c.mu.Unlock()
+		if conn != nil && !conn.IsClosed() {
+			err = conn.Close()
+		}
+	})
+	return err
+}
+
+func (c *Connection) awaitConn(ctx context.Context) (*amqp.Connection, error) {
+	c.mu.Lock()
+	conn, ready := c.conn, c.ready
+	c.mu.Unlock()
+
+	select {
+	case <-ready:
+		return conn, nil
+	case <-c.done:
+		return nil, ErrConnectionClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Connection) setConn(conn *amqp.Connection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
+	close(c.ready)
+}
+
+func (c *Connection) watch(conn *amqp.Connection) {
+	for {
+		closeErr := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+
+		c.mu.Lock()
+		c.ready = make(chan struct{})
+		c.mu.Unlock()
+
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+
+		log.Printf("RabbitMQ connection lost: %v. Reconnecting...", closeErr)
+
+		conn = c.redial()
+		if conn == nil {
+			return
+		}
+	}
+}
+
+// redial keeps dialing until it succeeds or the Connection is closed.
+func (c *Connection) redial() *amqp.Connection {
+	for attempt := 0; ; attempt++ {
+		conn, err := amqp.Dial(c.url)
+		if err == nil {
+			c.mu.Lock()
+			setup := append([]setupStep(nil), c.setup...)
+			c.mu.Unlock()
+
+			if err = runSetup(conn, setup...); err == nil {
+				select {
+				case <-c.done:
+					conn.Close()
+					return nil
+				default:
+				}
+				log.Printf("Reconnected to RabbitMQ after %d attempt(s)", attempt+1)
+				c.setConn(conn)
+				return conn
+			}
+			conn.Close()
+		}
+
+		wait := backoff(attempt)
+		log.Printf("RabbitMQ reconnect failed: %v. Retrying in %s", err, wait)
+
+		select {
+		case <-time.After(wait):
+		case <-c.done:
+			return nil
+		}
+	}
+}
+
+func runSetup(conn *amqp.Connection, setup ...setupStep) error {
+	if len(setup) == 0 {
+		return nil
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	for _, step := range setup {
+		if err := step.fn(ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backoff returns an exponential delay with jitter for the given attempt.
+func backoff(attempt int) time.Duration {
+	d := backoffMax
+	if attempt < 16 {
+		d = min(backoffBase<<attempt, backoffMax)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (c *Connection) ExchangeDeclare(name, kind string) error {
+	return c.declare("exchange:"+name, func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclare(name, kind, true, false, false, false, nil)
+	})
+}
+
+func (c *Connection) QueueDeclare(name string, simpleQueueType SimpleQueueType, args amqp.Table) error {
+	isDurable, isAutoDelete, isExclusive := queueFlags(simpleQueueType)
+	args = declareArgs(simpleQueueType, args)
+
+	fn := func(ch *amqp.Channel) error {
+		_, err := ch.QueueDeclare(
+			name,
+			isDurable,    // durable
+			isAutoDelete, // auto-delete
+			isExclusive,  // exclusive
+			false,        // noWait
+			args,         // args
+		)
+		return err
+	}
+	if isDelayQueue(name) {
+		// PublishDelayed declares these before every publish and lets them
+		// expire, so replaying them on reconnect would only recreate empty ones
+		conn, err := c.awaitConn(context.Background())
+		if err != nil {
+			return err
+		}
+		return runSetup(conn, setupStep{id: "queue:" + name, fn: fn})
+	}
+	return c.declare("queue:"+name, fn)
+}
+
+func (c *Connection) QueueBind(queueName, key, exchange string) error {
+	return c.declare("bind:"+queueName+":"+exchange+":"+key, func(ch *amqp.Channel) error {
+		return ch.QueueBind(queueName, key, exchange, false, nil)
+	})
+}
+
+// Publish goes through a shared confirming Publisher; use NewPublisher for a
+// dedicated channel when one publisher would be a bottleneck.
+func (c *Connection) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	c.pubMu.Lock()
+	if c.publisher == nil {
+		publisher, err := NewPublisher(c, DefaultConfirmTimeout)
+		if err != nil {
+			c.pubMu.Unlock()
+			return err
+		}
+		c.publisher = publisher
+	}
+	publisher := c.publisher
+	c.pubMu.Unlock()
+
+	return publisher.Publish(ctx, exchange, key, msg)
+}
@@ -1,10 +1,11 @@
 package pubsub
 
 import (
-	"bytes"
-	"encoding/gob"
-	"encoding/json"
+	"context"
 	"fmt"
+	"log"
+	"sync"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -14,6 +15,10 @@ type SimpleQueueType int
 const (
 	SimpleQueueDurable SimpleQueueType = iota
 	SimpleQueueTransient
+	// SimpleQueueQuorum is a durable, replicated queue for clustered brokers.
+	SimpleQueueQuorum
+	// SimpleQueueStream is an append-only log; read it with SubscribeStream.
+	SimpleQueueStream
 )
 
 type AckType int
@@ -22,92 +27,186 @@ const (
 	Ack AckType = iota
 	NackRequeue
 	NackDiscard
+	// NackRetry re-publishes through the delayed retry queues (see WithRetry)
+	// and dead-letters once the attempt budget is used up.
+	NackRetry
 )
 
-func SubscribeJSON[T any](
-	conn *amqp.Connection,
+// Subscribe decodes each delivery with the codec matching its content type,
+// so producers can switch encodings without redeploying consumers first.
+// codec is used for deliveries that carry no content type.
+func Subscribe[T any](
+	ctx context.Context,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
 	simpleQueueType SimpleQueueType,
+	codec Codec,
 	handler func(T) AckType,
-) error {
-	return subscribe(conn, exchange, queueName, key, simpleQueueType, handler, func(data []byte) (T, error) {
-		var target T
-		err := json.Unmarshal(data, &target)
-		return target, err
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return SubscribeEnvelope(ctx, broker, exchange, queueName, key, simpleQueueType, codec, func(val T, _ Envelope) AckType {
+		return handler(val)
+	}, opts...)
+}
+
+// SubscribeEnvelope is Subscribe for handlers that also want the message
+// metadata (IDs, timestamp, trace context).
+func SubscribeEnvelope[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	codec Codec,
+	handler func(T, Envelope) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return subscribe(ctx, broker, exchange, queueName, key, simpleQueueType, handler, newSubscribeOptions(opts), func(msg amqp.Delivery) (T, error) {
+		return decodeBody[T](msg.ContentType, msg.Headers, msg.Body, codec)
 	})
 }
 
+func SubscribeJSON[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	handler func(T) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return Subscribe(ctx, broker, exchange, queueName, key, simpleQueueType, JSON, handler, opts...)
+}
+
 func SubscribeGob[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
 	simpleQueueType SimpleQueueType,
 	handler func(T) AckType,
-) error {
-	return subscribe(conn, exchange, queueName, key, simpleQueueType, handler, func(data []byte) (T, error) {
-		var target T
-		buf := bytes.NewBuffer(data)
-		dec := gob.NewDecoder(buf)
-		err := dec.Decode(&target)
-		return target, err
-	})
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return Subscribe(ctx, broker, exchange, queueName, key, simpleQueueType, Gob, handler, opts...)
 }
 
 func subscribe[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
 	simpleQueueType SimpleQueueType,
-	handler func(T) AckType,
-	unmarshaller func([]byte) (T, error),
-) error {
-	ch, queue, err := DeclareAndBind(conn, exchange, queueName, key, simpleQueueType)
+	handler func(T, Envelope) AckType,
+	options subscribeOptions,
+	unmarshaller func(amqp.Delivery) (T, error),
+) (*Subscription, error) {
+	wrapped, err := buildHandler(Handler[T](handler), options)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = ch.Qos(1, 0, false) // 1 video per worker
+	var args amqp.Table
+	queue, declared := options.topology.Queue(queueName)
+	if declared {
+		args = QueueArgs(queue)
+	}
+	err = DeclareAndBind(broker, exchange, queueName, key, simpleQueueType, args)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	msgs, err := ch.Consume(
-		queue.Name,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
+	if options.retry.MaxAttempts > 0 {
+		err = DeclareRetryQueues(broker, exchange, queueName, key, options.retry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sub := newSubscription(ctx, broker, queueName)
+	if declared {
+		sub.deadLetterExchange = queue.DeadLetterExchange
+		sub.deadLetterKey = queue.DeadLetterRoutingKey
+	}
+
+	msgs, err := broker.Consume(sub.ctx, queueName, sub.tag, options.prefetch)
 	if err != nil {
-		return err
+		sub.stop()
+		return nil, err
 	}
 
 	go func() {
-		for msg := range msgs {
-			target, err := unmarshaller(msg.Body)
-			if err != nil {
-				fmt.Printf("Error unmarshalling message: %v\n", err)
-				msg.Nack(false, false)
-				continue
-			}
-
-			ackType := handler(target)
-			switch ackType {
-			case Ack:
-				msg.Ack(false)
-			case NackRequeue:
-				msg.Nack(false, true)
-			case NackDiscard:
-				msg.Nack(false, false)
-			}
+		defer sub.finish()
+
+		// Each worker acks the deliveries it handled, so tags always match up
+		var workers sync.WaitGroup
+		for i := 0; i < options.concurrency; i++ {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				for msg := range msgs {
+					handleDelivery(sub, msg, wrapped, options, unmarshaller)
+				}
+			}()
 		}
+		workers.Wait()
 	}()
 
-	return nil
+	return sub, nil
+}
+
+func handleDelivery[T any](
+	sub *Subscription,
+	msg amqp.Delivery,
+	handler Handler[T],
+	options subscribeOptions,
+	unmarshaller func(amqp.Delivery) (T, error),
+) {
+	deliveriesTotal.WithLabelValues(sub.queue).Inc()
+
+	requeues, requeuedErr := sub.tracker.lookup(msg.MessageId)
+	attempts := DeliveryAttempts(msg, requeues)
+
+	if options.poisonLimit > 0 && attempts > options.poisonLimit {
+		log.Printf("Message %s on %s is poison after %d deliveries, dead-lettering", msg.MessageId, sub.queue, attempts-1)
+		sub.deadLetter(msg, "poison", attempts-1, lastError(msg, nil, requeuedErr))
+		return
+	}
+
+	if restoreErr, ok := msg.Headers[restoreErrorHeader].(string); ok {
+		decodeFailuresTotal.WithLabelValues(sub.queue).Inc()
+		sub.deadLetter(msg, "undecodable", attempts, restoreErr)
+		return
+	}
+
+	target, err := unmarshaller(msg)
+	if err != nil {
+		fmt.Printf("Error unmarshalling message: %v\n", err)
+		decodeFailuresTotal.WithLabelValues(sub.queue).Inc()
+		sub.deadLetter(msg, "undecodable", attempts, err.Error())
+		return
+	}
+
+	env := envelopeFromDelivery(msg)
+	start := time.Now()
+	ackType := handler(target, env)
+	observeHandled(sub.queue, msg, start, ackType.String())
+
+	switch ackType {
+	case Ack:
+		sub.tracker.forget(msg.MessageId)
+		sub.ack(msg.Ack(false))
+	case NackRequeue:
+		sub.tracker.requeued(msg.MessageId, env.RecordedError())
+		sub.ack(msg.Nack(false, true))
+	case NackDiscard:
+		sub.deadLetter(msg, "rejected", attempts, lastError(msg, env.RecordedError(), requeuedErr))
+	case NackRetry:
+		sub.retry(msg, options.retry, attempts, lastError(msg, env.RecordedError(), requeuedErr))
+	}
 }
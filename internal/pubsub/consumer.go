@@ -0,0 +1,189 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// amqpConsumer forwards deliveries from whichever channel is currently
+// consuming, re-subscribing after the channel or connection drops.
+type amqpConsumer struct {
+	conn     *Connection
+	queue    string
+	tag      string
+	prefetch int
+	// args returns the basic.consume arguments, asked again on every re-subscribe
+	args func() amqp.Table
+	// seen is called with each delivery before it is handed out
+	seen func(amqp.Delivery)
+
+	mu sync.Mutex
+	ch *amqp.Channel
+
+	inflight sync.WaitGroup
+}
+
+// trackedAck counts a delivery as finished once it has been acked or nacked,
+// so a cancelled consumer can keep its channel open until handlers are done.
+type trackedAck struct {
+	amqp.Acknowledger
+	once sync.Once
+	done func()
+}
+
+func (t *trackedAck) Ack(tag uint64, multiple bool) error {
+	defer t.once.Do(t.done)
+	return t.Acknowledger.Ack(tag, multiple)
+}
+
+func (t *trackedAck) Nack(tag uint64, multiple, requeue bool) error {
+	defer t.once.Do(t.done)
+	return t.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (t *trackedAck) Reject(tag uint64, requeue bool) error {
+	defer t.once.Do(t.done)
+	return t.Acknowledger.Reject(tag, requeue)
+}
+
+func (c *Connection) Consume(ctx context.Context, queueName, consumerTag string, prefetch int) (<-chan amqp.Delivery, error) {
+	return c.consume(ctx, &amqpConsumer{conn: c, queue: queueName, tag: consumerTag, prefetch: prefetch})
+}
+
+func (c *Connection) consume(ctx context.Context, consumer *amqpConsumer) (<-chan amqp.Delivery, error) {
+	msgs, err := consumer.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan amqp.Delivery)
+	stop := context.AfterFunc(ctx, consumer.cancel)
+
+	go func() {
+		defer close(out)
+		defer stop()
+
+		for {
+			for msg := range msgs {
+				if consumer.seen != nil {
+					consumer.seen(msg)
+				}
+				consumer.inflight.Add(1)
+				msg.Acknowledger = &trackedAck{Acknowledger: msg.Acknowledger, done: consumer.inflight.Done}
+				out <- msg
+			}
+
+			if ctx.Err() != nil {
+				// Handlers still need the channel to ack what they are working on
+				go func() {
+					consumer.inflight.Wait()
+					consumer.close()
+				}()
+				return
+			}
+
+			// Deliveries stop when the channel or connection drops, so re-subscribe once the broker is back.
+			// Acks for the old channel will fail and the broker redelivers those messages.
+			consumer.close()
+			msgs = consumer.reopen(ctx)
+			if msgs == nil {
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (a *amqpConsumer) open(ctx context.Context) (<-chan amqp.Delivery, error) {
+	ch, err := a.conn.Channel(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ch.Qos(a.prefetch, 0, false)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	var args amqp.Table
+	if a.args != nil {
+		args = a.args()
+	}
+
+	msgs, err := ch.Consume(
+		a.queue,
+		a.tag,
+		false,
+		false,
+		false,
+		false,
+		args,
+	)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.ch = ch
+	a.mu.Unlock()
+
+	// Shutdown may have raced with a re-subscribe
+	if ctx.Err() != nil {
+		a.cancel()
+	}
+	return msgs, nil
+}
+
+func (a *amqpConsumer) reopen(ctx context.Context) <-chan amqp.Delivery {
+	for attempt := 0; ; attempt++ {
+		msgs, err := a.open(ctx)
+		if err == nil {
+			log.Printf("Re-subscribed to queue %s", a.queue)
+			return msgs
+		}
+		if errors.Is(err, ErrConnectionClosed) || ctx.Err() != nil {
+			return nil
+		}
+
+		wait := backoff(attempt)
+		log.Printf("Re-subscribe to queue %s failed: %v. Retrying in %s", a.queue, err, wait)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// cancel sends basic.cancel; the broker stops delivering and msgs closes.
+func (a *amqpConsumer) cancel() {
+	a.mu.Lock()
+	ch := a.ch
+	a.mu.Unlock()
+
+	if ch == nil || ch.IsClosed() {
+		return
+	}
+	if err := ch.Cancel(a.tag, false); err != nil {
+		log.Printf("Cancel consumer %s failed: %v", a.tag, err)
+	}
+}
+
+// close releases the channel. Anything still unacked on it is requeued.
+func (a *amqpConsumer) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.ch != nil && !a.ch.IsClosed() {
+		a.ch.Close()
+	}
+}
@@ -0,0 +1,74 @@
+package pubsub
+
+import (
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Death is one entry of the x-death header RabbitMQ adds when it dead-letters a message.
+type Death struct {
+	Reason      string
+	Count       int64
+	Queue       string
+	Exchange    string
+	RoutingKeys []string
+	Time        time.Time
+}
+
+// Deaths parses the x-death header, most recent entry first.
+func Deaths(headers amqp.Table) []Death {
+	raw, ok := headers["x-death"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var deaths []Death
+	for _, entry := range raw {
+		table, ok := entry.(amqp.Table)
+		if !ok {
+			continue
+		}
+
+		death := Death{}
+		death.Reason, _ = table["reason"].(string)
+		death.Queue, _ = table["queue"].(string)
+		death.Exchange, _ = table["exchange"].(string)
+		death.Time, _ = table["time"].(time.Time)
+		death.Count = int64(headerInt(table, "count"))
+
+		if keys, ok := table["routing-keys"].([]interface{}); ok {
+			for _, key := range keys {
+				if s, ok := key.(string); ok {
+					death.RoutingKeys = append(death.RoutingKeys, s)
+				}
+			}
+		}
+
+		deaths = append(deaths, death)
+	}
+	return deaths
+}
+
+// addDeath bumps the count of an existing x-death entry for the same queue
+// and reason or prepends a new one, as RabbitMQ does.
+func addDeath(existing interface{}, entry amqp.Table) []interface{} {
+	deaths, _ := existing.([]interface{})
+
+	for i, raw := range deaths {
+		death, ok := raw.(amqp.Table)
+		if ok && death["queue"] == entry["queue"] && death["reason"] == entry["reason"] {
+			for k, v := range death {
+				if _, set := entry[k]; !set {
+					entry[k] = v
+				}
+			}
+			entry["count"] = int64(headerInt(death, "count") + 1)
+			rest := append(append([]interface{}{}, deaths[:i]...), deaths[i+1:]...)
+			return append([]interface{}{entry}, rest...)
+		}
+	}
+
+	entry["count"] = int64(1)
+	return append([]interface{}{entry}, deaths...)
+}
@@ -0,0 +1,93 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// DelayQueuePrefix starts the name of every queue PublishDelayed parks
+	// messages in.
+	DelayQueuePrefix = "delay."
+	// DeliverAtHeader is when a delayed message is due, in RFC 3339.
+	DeliverAtHeader = "x-deliver-at"
+
+	// delayQueueGrace keeps an idle delay queue around a little longer than
+	// its TTL, so it is never deleted while it still holds messages.
+	delayQueueGrace = time.Minute
+)
+
+// DelayQueueName is the queue that holds messages for exchange and key for
+// delay. Delays are whole seconds, so there is at most one queue per second.
+func DelayQueueName(exchange, key string, delay time.Duration) string {
+	if exchange == "" {
+		exchange = "default"
+	}
+	return fmt.Sprintf("%s%s.%s.%ds", DelayQueuePrefix, exchange, key, int64(delay/time.Second))
+}
+
+// isDelayQueue reports whether a dead-lettering from queue was just a delay
+// running out rather than a failed attempt.
+func isDelayQueue(queue string) bool {
+	return strings.HasPrefix(queue, DelayQueuePrefix)
+}
+
+// PublishDelayed is Publish, but the message reaches exchange only after
+// delay. It waits in a consumerless queue whose x-message-ttl is the delay
+// and whose dead letter exchange and routing key are exchange and key, so it
+// needs no broker plugin. Delays are rounded up to the second; a delay under
+// a second publishes straight away. Delay queues are not redeclared when the
+// connection comes back, only by the next PublishDelayed for them.
+//
+// Every delay gets its own queue, so keep delays to a handful of values or
+// short (minutes); far-future jobs belong in a scheduler that calls this
+// when they are almost due.
+func PublishDelayed[T any](
+	ctx context.Context,
+	broker Broker,
+	codec Codec,
+	exchange,
+	routingKey string,
+	val T,
+	delay time.Duration,
+) error {
+	if delay < time.Second {
+		return Publish(ctx, broker, codec, exchange, routingKey, val)
+	}
+	if rest := delay % time.Second; rest != 0 {
+		delay += time.Second - rest
+	}
+
+	queue, err := declareDelayQueue(broker, exchange, routingKey, delay)
+	if err != nil {
+		return err
+	}
+
+	msg, err := newPublishing(ctx, codec, val)
+	if err != nil {
+		return err
+	}
+	msg.Headers[DeliverAtHeader] = time.Now().Add(delay).UTC().Format(time.RFC3339)
+
+	return broker.Publish(ctx, "", queue, msg)
+}
+
+// declareDelayQueue declares the delay queue on every publish, which also
+// resets its x-expires so it only goes away once it has been idle and empty.
+func declareDelayQueue(broker Broker, exchange, key string, delay time.Duration) (string, error) {
+	queue := DelayQueueName(exchange, key, delay)
+	err := broker.QueueDeclare(queue, SimpleQueueDurable, amqp.Table{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-expires":                 (delay + delayQueueGrace).Milliseconds(),
+		"x-dead-letter-exchange":    exchange,
+		"x-dead-letter-routing-key": key,
+	})
+	if err != nil {
+		return "", fmt.Errorf("declare delay queue %s: %w", queue, err)
+	}
+	return queue, nil
+}
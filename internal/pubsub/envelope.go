@@ -0,0 +1,193 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const TraceParentHeader = "traceparent"
+
+// AppID is stamped on every message published through Publish. Binaries
+// set it at startup so consumers can tell who sent a message.
+var AppID = filepath.Base(os.Args[0])
+
+// Envelope is the metadata that travels with a message: who sent it, when,
+// and which request/trace it belongs to.
+type Envelope struct {
+	MessageID     string
+	CorrelationID string
+	Timestamp     time.Time
+	AppID         string
+	TraceParent   string // W3C trace context, "00-<trace id>-<span id>-<flags>"
+	RoutingKey    string
+	ReplyTo       string // set on requests sent with Call
+	Redelivered   bool
+	Headers       amqp.Table
+
+	failure *failure        // where RecordError keeps the handler's error
+	ctx     context.Context // see Context
+}
+
+// Context is cancelled when the handler should give up on the message, such
+// as when WithHandlerTimeout expires. Handlers doing long work pass it on to
+// the commands and requests they start.
+func (e Envelope) Context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
+// WithContext returns a copy of e whose Context is ctx.
+func (e Envelope) WithContext(ctx context.Context) Envelope {
+	e.ctx = ctx
+	return e
+}
+
+type failure struct {
+	mu  sync.Mutex
+	err error
+}
+
+// RecordError notes why handling failed. If the message ends up dead-lettered
+// the error is written to its LastErrorHeader, and it is carried along with
+// retries and requeues, so the failed queue says what went wrong.
+func (e Envelope) RecordError(err error) {
+	if e.failure == nil || err == nil {
+		return
+	}
+	e.failure.mu.Lock()
+	e.failure.err = err
+	e.failure.mu.Unlock()
+}
+
+// RecordedError returns what the handler passed to RecordError, if anything,
+// so middleware can report why a message failed.
+func (e Envelope) RecordedError() error {
+	if e.failure == nil {
+		return nil
+	}
+	e.failure.mu.Lock()
+	defer e.failure.mu.Unlock()
+	return e.failure.err
+}
+
+// RetryAttempt is how many delayed retries the message has had (see WithRetry).
+func (e Envelope) RetryAttempt() int {
+	return headerInt(e.Headers, RetryAttemptHeader)
+}
+
+// TraceID returns the trace id part of the traceparent, or "" if it is not valid.
+func (e Envelope) TraceID() string {
+	traceID, _, ok := parseTraceParent(e.TraceParent)
+	if !ok {
+		return ""
+	}
+	return traceID
+}
+
+type envelopeKey struct{}
+
+// ContextWithEnvelope makes messages published with ctx part of the same
+// correlation and trace as env.
+func ContextWithEnvelope(ctx context.Context, env Envelope) context.Context {
+	return context.WithValue(ctx, envelopeKey{}, env)
+}
+
+func EnvelopeFromContext(ctx context.Context) (Envelope, bool) {
+	env, ok := ctx.Value(envelopeKey{}).(Envelope)
+	return env, ok
+}
+
+func NewMessageID() string {
+	return randomHex(16)
+}
+
+func NewTraceParent() string {
+	return "00-" + randomHex(16) + "-" + randomHex(8) + "-01"
+}
+
+// ChildTraceParent keeps the trace id of parent with a new span id, or
+// starts a new trace if parent is missing or malformed.
+func ChildTraceParent(parent string) string {
+	traceID, _, ok := parseTraceParent(parent)
+	if !ok {
+		return NewTraceParent()
+	}
+	return "00-" + traceID + "-" + randomHex(8) + "-" + parent[len(parent)-2:]
+}
+
+func parseTraceParent(value string) (traceID, spanID string, ok bool) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", false
+	}
+	for _, part := range parts {
+		if _, err := hex.DecodeString(part); err != nil {
+			return "", "", false
+		}
+	}
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// stamp fills in the envelope fields of an outgoing message, continuing
+// the correlation and trace found in ctx.
+func stamp(ctx context.Context, msg *amqp.Publishing) {
+	parent, _ := EnvelopeFromContext(ctx)
+
+	if msg.MessageId == "" {
+		msg.MessageId = NewMessageID()
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now().UTC()
+	}
+	if msg.AppId == "" {
+		msg.AppId = AppID
+	}
+	if msg.CorrelationId == "" {
+		msg.CorrelationId = parent.CorrelationID
+	}
+	if msg.CorrelationId == "" {
+		msg.CorrelationId = msg.MessageId
+	}
+
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	if _, ok := msg.Headers[TraceParentHeader]; !ok {
+		msg.Headers[TraceParentHeader] = ChildTraceParent(parent.TraceParent)
+	}
+}
+
+func envelopeFromDelivery(msg amqp.Delivery) Envelope {
+	traceParent, _ := msg.Headers[TraceParentHeader].(string)
+	return Envelope{
+		MessageID:     msg.MessageId,
+		CorrelationID: msg.CorrelationId,
+		Timestamp:     msg.Timestamp,
+		AppID:         msg.AppId,
+		TraceParent:   traceParent,
+		RoutingKey:    msg.RoutingKey,
+		ReplyTo:       msg.ReplyTo,
+		Redelivered:   msg.Redelivered,
+		Headers:       msg.Headers,
+		failure:       &failure{},
+	}
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
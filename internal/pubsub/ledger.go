@@ -0,0 +1,106 @@
+package pubsub
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// StepHandled is the ledger step the Idempotent middleware records once a
+// message has been acked.
+const StepHandled = "handled"
+
+// Ledger remembers which steps of a message (or job) have completed, in the
+// processed_messages table, so a redelivery can skip work that already
+// happened. RabbitMQ delivers at least once; the ledger makes handling
+// effectively once.
+type Ledger struct {
+	db *sql.DB
+}
+
+func NewLedger(db *sql.DB) *Ledger {
+	return &Ledger{db: db}
+}
+
+// EnsureTable creates processed_messages if it does not exist. The ledger
+// lives in its own database, such as a worker's local file, rather than in
+// the migrated one, so this is the table's only definition.
+func (l *Ledger) EnsureTable() error {
+	_, err := l.db.Exec(`CREATE TABLE IF NOT EXISTS processed_messages (
+		message_key TEXT NOT NULL,
+		step TEXT NOT NULL,
+		result TEXT NOT NULL DEFAULT '',
+		processed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (message_key, step)
+	)`)
+	return err
+}
+
+// Lookup returns the result recorded for key/step and whether it exists.
+func (l *Ledger) Lookup(key, step string) (string, bool, error) {
+	var result string
+	err := l.db.QueryRow(
+		"SELECT result FROM processed_messages WHERE message_key = ? AND step = ?",
+		key, step,
+	).Scan(&result)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return result, true, nil
+}
+
+func (l *Ledger) Record(key, step, result string) error {
+	_, err := l.db.Exec(
+		"INSERT OR REPLACE INTO processed_messages (message_key, step, result, processed_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)",
+		key, step, result,
+	)
+	return err
+}
+
+// Forget drops every step recorded for key, e.g. to force a full re-process.
+func (l *Ledger) Forget(key string) error {
+	_, err := l.db.Exec("DELETE FROM processed_messages WHERE message_key = ?", key)
+	return err
+}
+
+// Prune drops entries recorded before cutoff. Redeliveries come within
+// hours, so old entries only take up space.
+func (l *Ledger) Prune(cutoff time.Time) (int64, error) {
+	res, err := l.db.Exec("DELETE FROM processed_messages WHERE processed_at < ?", cutoff.UTC().Format(time.DateTime))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Idempotent acks messages whose key was already handled without calling the
+// handler again, and records the key once the handler acks. Key on a business
+// ID (like a job ID) to also swallow duplicate publishes, or on
+// env.MessageID to only swallow redeliveries.
+func Idempotent[T any](ledger *Ledger, key func(T, Envelope) string) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(val T, env Envelope) AckType {
+			k := key(val, env)
+
+			_, done, err := ledger.Lookup(k, StepHandled)
+			if err != nil {
+				log.Printf("Ledger lookup for %s failed, handling message anyway: %v", k, err)
+			} else if done {
+				log.Printf("Message %s (%s) already handled, skipping duplicate", env.MessageID, k)
+				return Ack
+			}
+
+			ackType := next(val, env)
+			if ackType == Ack {
+				if err := ledger.Record(k, StepHandled, env.MessageID); err != nil {
+					log.Printf("Ledger record for %s failed: %v", k, err)
+				}
+			}
+			return ackType
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package pubsub
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestLedgerPruneDropsOldEntries(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	ledger := NewLedger(db)
+	if err := ledger.EnsureTable(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"msg-old", "msg-new"} {
+		if err := ledger.Record(key, StepHandled, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("UPDATE processed_messages SET processed_at = datetime('now', '-8 days') WHERE message_key = 'msg-old'"); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := ledger.Prune(time.Now().Add(-7 * 24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 1 {
+		t.Fatalf("expected 1 entry pruned, got %d", pruned)
+	}
+	if _, done, _ := ledger.Lookup("msg-old", StepHandled); done {
+		t.Fatalf("expected the old entry to be gone")
+	}
+	if _, done, _ := ledger.Lookup("msg-new", StepHandled); !done {
+		t.Fatalf("expected the recent entry to be kept")
+	}
+}
@@ -0,0 +1,707 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MemoryBroker is an in-process Broker for tests. It follows RabbitMQ's
+// routing rules for the default, direct, fanout and topic exchanges and
+// honours acks, requeues, prefetch, x-message-ttl, per-message expiration
+// and dead-letter exchanges (including the x-death header). Stream queues
+// keep every message and are read from an offset with ConsumeStream; their
+// retention is not enforced. Nothing is persisted.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	exchanges map[string]string
+	queues    map[string]*memoryQueue
+	bindings  []memoryBinding
+	unacked   map[uint64]*memoryUnacked
+	nextTag   uint64
+}
+
+type memoryBinding struct {
+	queue    string
+	key      string
+	exchange string
+}
+
+type memoryQueue struct {
+	name      string
+	args      amqp.Table
+	ready     []*memoryMessage
+	consumers []*memoryConsumer
+	next      int // round-robin position
+
+	// Stream queues only: every message published, by offset, and its readers
+	log     []*memoryMessage
+	readers []*memoryStreamReader
+}
+
+type memoryMessage struct {
+	exchange    string
+	key         string
+	msg         amqp.Publishing
+	redelivered bool
+	// Times the message was requeued, as quorum queues count it
+	deliveryCount int
+	// When a stream stored it
+	storedAt time.Time
+}
+
+type memoryConsumer struct {
+	tag        string
+	limit      int
+	inflight   int
+	deliveries chan amqp.Delivery
+}
+
+// memoryStreamReader is one ConsumeStream consumer. Stream deliveries are
+// not requeued, so acks only make room under the prefetch.
+type memoryStreamReader struct {
+	tag        string
+	limit      int
+	offset     int // next offset to deliver
+	nextTag    uint64
+	unacked    map[uint64]bool
+	deliveries chan amqp.Delivery
+	closed     bool
+}
+
+// memoryStreamAcker is the Acknowledger on deliveries from a stream.
+type memoryStreamAcker struct {
+	broker *MemoryBroker
+	queue  *memoryQueue
+	reader *memoryStreamReader
+}
+
+type memoryUnacked struct {
+	queue    *memoryQueue
+	consumer *memoryConsumer
+	message  *memoryMessage
+}
+
+// memoryAcker is the Acknowledger on deliveries handed out by a MemoryBroker.
+type memoryAcker struct {
+	broker *MemoryBroker
+}
+
+const memoryUnlimitedPrefetch = 256
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		exchanges: map[string]string{},
+		queues:    map[string]*memoryQueue{},
+		unacked:   map[uint64]*memoryUnacked{},
+	}
+}
+
+func (b *MemoryBroker) ExchangeDeclare(name, kind string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch kind {
+	case "direct", "fanout", "topic":
+	default:
+		return fmt.Errorf("pubsub: memory broker does not support %q exchanges", kind)
+	}
+
+	if existing, ok := b.exchanges[name]; ok && existing != kind {
+		return fmt.Errorf("pubsub: exchange %s already declared as %s", name, existing)
+	}
+	b.exchanges[name] = kind
+	return nil
+}
+
+func (b *MemoryBroker) QueueDeclare(name string, simpleQueueType SimpleQueueType, args amqp.Table) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	args = declareArgs(simpleQueueType, args)
+	existing, ok := b.queues[name]
+	if !ok {
+		b.queues[name] = &memoryQueue{name: name, args: args}
+		return nil
+	}
+	// RabbitMQ refuses to redeclare a queue with different arguments
+	if !sameArgs(existing.args, args) {
+		return fmt.Errorf("pubsub: queue %s already declared with arguments %v, not %v", name, existing.args, args)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) QueueBind(queueName, key, exchange string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.queues[queueName]; !ok {
+		return fmt.Errorf("pubsub: queue %s not declared", queueName)
+	}
+	if _, ok := b.exchanges[exchange]; !ok {
+		return fmt.Errorf("pubsub: exchange %s not declared", exchange)
+	}
+
+	binding := memoryBinding{queue: queueName, key: key, exchange: exchange}
+	for _, existing := range b.bindings {
+		if existing == binding {
+			return nil
+		}
+	}
+	b.bindings = append(b.bindings, binding)
+	return nil
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	queues, err := b.route(exchange, key)
+	if err != nil {
+		return err
+	}
+	if len(queues) == 0 {
+		return fmt.Errorf("%w: %s/%s", ErrUnroutable, exchange, key)
+	}
+
+	for _, queue := range queues {
+		b.enqueue(queue, &memoryMessage{exchange: exchange, key: key, msg: copyPublishing(msg)})
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Consume(ctx context.Context, queueName, consumerTag string, prefetch int) (<-chan amqp.Delivery, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	queue, ok := b.queues[queueName]
+	if !ok {
+		return nil, fmt.Errorf("pubsub: queue %s not declared", queueName)
+	}
+	if queue.isStream() {
+		return nil, fmt.Errorf("pubsub: queue %s is a stream, read it with ConsumeStream", queueName)
+	}
+
+	// Deliveries are buffered up to the prefetch so dispatch never blocks
+	limit := prefetch
+	if limit <= 0 {
+		limit = memoryUnlimitedPrefetch
+	}
+
+	consumer := &memoryConsumer{
+		tag:        consumerTag,
+		limit:      limit,
+		deliveries: make(chan amqp.Delivery, limit),
+	}
+	queue.consumers = append(queue.consumers, consumer)
+	b.dispatch(queue)
+
+	context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		for i, c := range queue.consumers {
+			if c == consumer {
+				queue.consumers = append(queue.consumers[:i], queue.consumers[i+1:]...)
+				break
+			}
+		}
+		close(consumer.deliveries)
+	})
+
+	return consumer.deliveries, nil
+}
+
+// ConsumeStream reads the stream queue streamName from offset until ctx is
+// cancelled. Every message is a chunk of its own, so StreamLast starts at the
+// last message. Deliveries carry their offset in StreamOffsetHeader.
+func (b *MemoryBroker) ConsumeStream(ctx context.Context, streamName, consumerTag string, prefetch int, offset StreamOffset) (<-chan amqp.Delivery, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	queue, ok := b.queues[streamName]
+	if !ok {
+		return nil, fmt.Errorf("pubsub: queue %s not declared", streamName)
+	}
+	if !queue.isStream() {
+		return nil, fmt.Errorf("pubsub: queue %s is not a stream", streamName)
+	}
+	start, err := queue.start(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := prefetch
+	if limit <= 0 {
+		limit = defaultStreamPrefetch
+	}
+	reader := &memoryStreamReader{
+		tag:        consumerTag,
+		limit:      limit,
+		offset:     start,
+		unacked:    map[uint64]bool{},
+		deliveries: make(chan amqp.Delivery, limit),
+	}
+	queue.readers = append(queue.readers, reader)
+	b.feed(queue, reader)
+
+	context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		for i, r := range queue.readers {
+			if r == reader {
+				queue.readers = append(queue.readers[:i], queue.readers[i+1:]...)
+				break
+			}
+		}
+		reader.closed = true
+		close(reader.deliveries)
+	})
+
+	return reader.deliveries, nil
+}
+
+// QueueLen reports how many messages are ready (not yet delivered) in a
+// queue, or how many a stream holds.
+func (b *MemoryBroker) QueueLen(queueName string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	queue, ok := b.queues[queueName]
+	if !ok {
+		return 0
+	}
+	if queue.isStream() {
+		return len(queue.log)
+	}
+	return len(queue.ready)
+}
+
+// Get removes and returns the next ready message from a queue without
+// going through a consumer, like basic.get with auto-ack.
+func (b *MemoryBroker) Get(queueName string) (amqp.Delivery, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	queue, ok := b.queues[queueName]
+	if !ok || len(queue.ready) == 0 {
+		return amqp.Delivery{}, false
+	}
+
+	message := queue.ready[0]
+	queue.ready = queue.ready[1:]
+	return message.delivery(0, ""), true
+}
+
+func (b *MemoryBroker) route(exchange, key string) ([]*memoryQueue, error) {
+	// The default exchange routes straight to the queue named by the key
+	if exchange == "" {
+		if queue, ok := b.queues[key]; ok {
+			return []*memoryQueue{queue}, nil
+		}
+		return nil, nil
+	}
+
+	kind, ok := b.exchanges[exchange]
+	if !ok {
+		return nil, fmt.Errorf("pubsub: exchange %s not declared", exchange)
+	}
+
+	var queues []*memoryQueue
+	seen := map[string]bool{}
+	for _, binding := range b.bindings {
+		if binding.exchange != exchange || seen[binding.queue] {
+			continue
+		}
+
+		matched := false
+		switch kind {
+		case "fanout":
+			matched = true
+		case "direct":
+			matched = binding.key == key
+		case "topic":
+			matched = topicMatch(binding.key, key)
+		}
+
+		if matched {
+			seen[binding.queue] = true
+			queues = append(queues, b.queues[binding.queue])
+		}
+	}
+	return queues, nil
+}
+
+func (b *MemoryBroker) enqueue(queue *memoryQueue, message *memoryMessage) {
+	if queue.isStream() {
+		message.storedAt = time.Now()
+		queue.log = append(queue.log, message)
+		for _, reader := range queue.readers {
+			b.feed(queue, reader)
+		}
+		return
+	}
+
+	queue.insert(message, false)
+
+	if ttl, ok := messageTTL(queue, message); ok {
+		time.AfterFunc(ttl, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.expire(queue, message)
+		})
+	}
+
+	b.dispatch(queue)
+}
+
+func (b *MemoryBroker) dispatch(queue *memoryQueue) {
+	for len(queue.ready) > 0 {
+		consumer := queue.nextConsumer()
+		if consumer == nil {
+			return
+		}
+
+		message := queue.ready[0]
+		queue.ready = queue.ready[1:]
+
+		b.nextTag++
+		b.unacked[b.nextTag] = &memoryUnacked{queue: queue, consumer: consumer, message: message}
+		consumer.inflight++
+
+		delivery := message.delivery(b.nextTag, consumer.tag)
+		delivery.Acknowledger = memoryAcker{broker: b}
+		consumer.deliveries <- delivery
+	}
+}
+
+// feed hands reader the stream's messages from its offset on, up to its
+// prefetch.
+func (b *MemoryBroker) feed(queue *memoryQueue, reader *memoryStreamReader) {
+	for !reader.closed && reader.offset < len(queue.log) && len(reader.unacked) < reader.limit {
+		message := queue.log[reader.offset]
+
+		reader.nextTag++
+		reader.unacked[reader.nextTag] = true
+
+		delivery := message.delivery(reader.nextTag, reader.tag)
+		if delivery.Headers == nil {
+			delivery.Headers = amqp.Table{}
+		}
+		delivery.Headers[StreamOffsetHeader] = int64(reader.offset)
+		delivery.Acknowledger = memoryStreamAcker{broker: b, queue: queue, reader: reader}
+		reader.deliveries <- delivery
+		reader.offset++
+	}
+}
+
+func (q *memoryQueue) isStream() bool {
+	return q.args["x-queue-type"] == "stream"
+}
+
+// start resolves where a stream reader begins in q's log.
+func (q *memoryQueue) start(offset StreamOffset) (int, error) {
+	switch value := offset.arg().(type) {
+	case string:
+		switch value {
+		case "first":
+			return 0, nil
+		case "last":
+			return max(len(q.log)-1, 0), nil
+		case "next":
+			return len(q.log), nil
+		}
+	case int64:
+		return min(max(int(value), 0), len(q.log)), nil
+	case time.Time:
+		for i, message := range q.log {
+			if !message.storedAt.Before(value) {
+				return i, nil
+			}
+		}
+		return len(q.log), nil
+	}
+	return 0, fmt.Errorf("pubsub: unsupported stream offset %v", offset.arg())
+}
+
+// insert places message behind every ready message of the same or higher
+// priority, or in front of those of the same priority when it is requeued.
+func (q *memoryQueue) insert(message *memoryMessage, requeued bool) {
+	priority := q.priority(message)
+
+	i := 0
+	for ; i < len(q.ready); i++ {
+		other := q.priority(q.ready[i])
+		if other < priority || (requeued && other == priority) {
+			break
+		}
+	}
+	q.ready = append(q.ready, nil)
+	copy(q.ready[i+1:], q.ready[i:])
+	q.ready[i] = message
+}
+
+// priority is the level the queue sorts message into: two levels on quorum
+// queues, up to x-max-priority on classic ones, and one level otherwise.
+func (q *memoryQueue) priority(message *memoryMessage) int {
+	if q.args["x-queue-type"] == "quorum" {
+		if message.msg.Priority > 4 {
+			return 1
+		}
+		return 0
+	}
+	if limit := headerInt(q.args, "x-max-priority"); limit > 0 {
+		return min(int(message.msg.Priority), limit)
+	}
+	return 0
+}
+
+func (q *memoryQueue) nextConsumer() *memoryConsumer {
+	for i := 0; i < len(q.consumers); i++ {
+		consumer := q.consumers[(q.next+i)%len(q.consumers)]
+		if consumer.inflight < consumer.limit {
+			q.next = (q.next + i + 1) % len(q.consumers)
+			return consumer
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBroker) expire(queue *memoryQueue, message *memoryMessage) {
+	for i, ready := range queue.ready {
+		if ready == message {
+			queue.ready = append(queue.ready[:i], queue.ready[i+1:]...)
+			b.deadLetter(queue, message, "expired")
+			return
+		}
+	}
+}
+
+// deadLetter republishes to the queue's x-dead-letter-exchange with an
+// x-death entry, or drops the message when the queue has no DLX.
+func (b *MemoryBroker) deadLetter(queue *memoryQueue, message *memoryMessage, reason string) {
+	dlx, ok := queue.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+
+	key := message.key
+	if dlk, ok := queue.args["x-dead-letter-routing-key"].(string); ok {
+		key = dlk
+	}
+
+	msg := copyPublishing(message.msg)
+	msg.Expiration = ""
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	msg.Headers["x-death"] = addDeath(msg.Headers["x-death"], amqp.Table{
+		"reason":       reason,
+		"queue":        queue.name,
+		"exchange":     message.exchange,
+		"routing-keys": []interface{}{message.key},
+		"time":         time.Now(),
+	})
+
+	queues, err := b.route(dlx, key)
+	if err != nil {
+		return
+	}
+	for _, target := range queues {
+		b.enqueue(target, &memoryMessage{exchange: dlx, key: key, msg: copyPublishing(msg)})
+	}
+}
+
+func (b *MemoryBroker) settle(tag uint64, multiple bool, settle func(*memoryUnacked)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	unacked, ok := b.unacked[tag]
+	if !ok {
+		return fmt.Errorf("pubsub: unknown delivery tag %d", tag)
+	}
+
+	tags := []uint64{tag}
+	if multiple {
+		for other, u := range b.unacked {
+			if other < tag && u.consumer == unacked.consumer {
+				tags = append(tags, other)
+			}
+		}
+	}
+
+	touched := map[*memoryQueue]bool{}
+	for _, t := range tags {
+		u := b.unacked[t]
+		delete(b.unacked, t)
+		u.consumer.inflight--
+		settle(u)
+		touched[u.queue] = true
+	}
+
+	for queue := range touched {
+		b.dispatch(queue)
+	}
+	return nil
+}
+
+func (a memoryAcker) Ack(tag uint64, multiple bool) error {
+	return a.broker.settle(tag, multiple, func(*memoryUnacked) {})
+}
+
+func (a memoryAcker) Nack(tag uint64, multiple, requeue bool) error {
+	b := a.broker
+	return b.settle(tag, multiple, func(u *memoryUnacked) {
+		if requeue {
+			u.message.redelivered = true
+			if u.queue.args["x-queue-type"] == "quorum" {
+				u.message.deliveryCount++
+				if limit := headerInt(u.queue.args, "x-delivery-limit"); limit > 0 && u.message.deliveryCount > limit {
+					b.deadLetter(u.queue, u.message, "delivery_limit")
+					return
+				}
+			}
+			u.queue.insert(u.message, true)
+			return
+		}
+		b.deadLetter(u.queue, u.message, "rejected")
+	})
+}
+
+func (a memoryAcker) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func (a memoryStreamAcker) Ack(tag uint64, multiple bool) error {
+	b := a.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !a.reader.unacked[tag] {
+		return fmt.Errorf("pubsub: unknown delivery tag %d", tag)
+	}
+	for other := range a.reader.unacked {
+		if other == tag || (multiple && other < tag) {
+			delete(a.reader.unacked, other)
+		}
+	}
+	b.feed(a.queue, a.reader)
+	return nil
+}
+
+// Nack on a stream only settles the delivery: streams never requeue or
+// dead-letter.
+func (a memoryStreamAcker) Nack(tag uint64, multiple, requeue bool) error {
+	return a.Ack(tag, multiple)
+}
+
+func (a memoryStreamAcker) Reject(tag uint64, requeue bool) error {
+	return a.Ack(tag, false)
+}
+
+func (m *memoryMessage) delivery(tag uint64, consumerTag string) amqp.Delivery {
+	msg := copyPublishing(m.msg)
+	if m.deliveryCount > 0 {
+		if msg.Headers == nil {
+			msg.Headers = amqp.Table{}
+		}
+		msg.Headers["x-delivery-count"] = int64(m.deliveryCount)
+	}
+	return amqp.Delivery{
+		Headers:         msg.Headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		ConsumerTag:     consumerTag,
+		DeliveryTag:     tag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.key,
+		Body:            msg.Body,
+	}
+}
+
+func sameArgs(a, b amqp.Table) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		other, ok := b[key]
+		// Compare printed values so int and int64 TTLs are equal, as they are on the wire
+		if !ok || fmt.Sprint(value) != fmt.Sprint(other) {
+			return false
+		}
+	}
+	return true
+}
+
+// messageTTL is the smaller of the queue's x-message-ttl and the message's Expiration.
+func messageTTL(queue *memoryQueue, message *memoryMessage) (time.Duration, bool) {
+	ttl, ok := time.Duration(0), false
+
+	if _, set := queue.args["x-message-ttl"]; set {
+		ttl, ok = time.Duration(headerInt(queue.args, "x-message-ttl"))*time.Millisecond, true
+	}
+
+	if message.msg.Expiration != "" {
+		if ms, err := strconv.ParseInt(message.msg.Expiration, 10, 64); err == nil {
+			expiration := time.Duration(ms) * time.Millisecond
+			if !ok || expiration < ttl {
+				ttl, ok = expiration, true
+			}
+		}
+	}
+	return ttl, ok
+}
+
+// topicMatch applies AMQP topic rules: "*" matches one word, "#" zero or more.
+func topicMatch(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchWords(pattern[1:], words[1:])
+	}
+}
+
+func copyPublishing(msg amqp.Publishing) amqp.Publishing {
+	if msg.Headers != nil {
+		headers := make(amqp.Table, len(msg.Headers))
+		for k, v := range msg.Headers {
+			headers[k] = v
+		}
+		msg.Headers = headers
+	}
+	msg.Body = append([]byte(nil), msg.Body...)
+	return msg
+}
@@ -0,0 +1,702 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JerryG0311/Vidify/internal/routing"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func newVideoBroker(t *testing.T) *MemoryBroker {
+	t.Helper()
+
+	broker := NewMemoryBroker()
+	if err := ApplyTopology(broker, routing.VideoTopology); err != nil {
+		t.Fatalf("declare topology: %v", err)
+	}
+	return broker
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTopicMatch(t *testing.T) {
+	cases := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"video.upload", "video.upload", true},
+		{"video.upload", "video.uploaded", false},
+		{"video.*", "video.upload", true},
+		{"video.*", "video.upload.retry", false},
+		{"video.#", "video", true},
+		{"video.#", "video.upload.retry", true},
+		{"#.retry", "video.upload.retry", true},
+		{"*.upload", "video.upload", true},
+		{"*", "", true},
+	}
+
+	for _, tc := range cases {
+		if got := topicMatch(tc.pattern, tc.key); got != tc.want {
+			t.Errorf("topicMatch(%q, %q) = %v, want %v", tc.pattern, tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestMemoryBrokerUnroutable(t *testing.T) {
+	broker := NewMemoryBroker()
+	if err := broker.ExchangeDeclare(routing.ExchangeVideoTopic, "topic"); err != nil {
+		t.Fatalf("declare exchange: %v", err)
+	}
+
+	err := PublishJSON(broker, routing.ExchangeVideoTopic, routing.VideoUploadKey, routing.VideoJob{ID: "vid-1"})
+	if !errors.Is(err, ErrUnroutable) {
+		t.Fatalf("expected ErrUnroutable with no queue bound, got %v", err)
+	}
+}
+
+func TestSubscribeJSONAckAndRequeue(t *testing.T) {
+	broker := newVideoBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls atomic.Int32
+	sub, err := SubscribeJSON(ctx, broker, routing.ExchangeVideoTopic, routing.VideoQueue, routing.VideoUploadKey, SimpleQueueDurable,
+		func(job routing.VideoJob) AckType {
+			if job.ID != "vid-1" {
+				t.Errorf("unexpected job %q", job.ID)
+			}
+			if calls.Add(1) == 1 {
+				return NackRequeue
+			}
+			return Ack
+		},
+		WithTopology(routing.VideoTopology),
+	)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	if err := PublishJSON(broker, routing.ExchangeVideoTopic, routing.VideoUploadKey, routing.VideoJob{ID: "vid-1"}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	waitFor(t, "requeued job to be handled again", func() bool { return calls.Load() == 2 })
+
+	shutdownCtx, stop := context.WithTimeout(context.Background(), time.Second)
+	defer stop()
+	if err := sub.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if n := broker.QueueLen(routing.VideoQueue); n != 0 {
+		t.Fatalf("expected empty queue after ack, got %d", n)
+	}
+}
+
+func TestNackDiscardDeadLetters(t *testing.T) {
+	broker := newVideoBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := SubscribeJSON(ctx, broker, routing.ExchangeVideoTopic, routing.VideoQueue, routing.VideoUploadKey, SimpleQueueDurable,
+		func(job routing.VideoJob) AckType { return NackDiscard },
+		WithTopology(routing.VideoTopology),
+	)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	if err := PublishJSON(broker, routing.ExchangeVideoTopic, routing.VideoUploadKey, routing.VideoJob{ID: "vid-2"}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	waitFor(t, "job in failed queue", func() bool { return broker.QueueLen(routing.VideoDLQueue) == 1 })
+
+	msg, _ := broker.Get(routing.VideoDLQueue)
+	deaths := Deaths(msg.Headers)
+	if len(deaths) != 1 || deaths[0].Reason != "rejected" || deaths[0].Queue != routing.VideoQueue {
+		t.Fatalf("unexpected x-death %+v", deaths)
+	}
+	if len(deaths[0].RoutingKeys) != 1 || deaths[0].RoutingKeys[0] != routing.VideoUploadKey {
+		t.Fatalf("expected original routing key in x-death, got %v", deaths[0].RoutingKeys)
+	}
+}
+
+func TestNackRetryExhaustsBudget(t *testing.T) {
+	broker := newVideoBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls atomic.Int32
+	_, err := SubscribeJSON(ctx, broker, routing.ExchangeVideoTopic, routing.VideoQueue, routing.VideoUploadKey, SimpleQueueDurable,
+		func(job routing.VideoJob) AckType {
+			calls.Add(1)
+			return NackRetry
+		},
+		WithTopology(routing.VideoTopology),
+		WithRetry(RetryPolicy{MaxAttempts: 2, BaseDelay: 10 * time.Millisecond}),
+	)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	if err := PublishJSON(broker, routing.ExchangeVideoTopic, routing.VideoUploadKey, routing.VideoJob{ID: "vid-3"}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	waitFor(t, "job in failed queue", func() bool { return broker.QueueLen(routing.VideoDLQueue) == 1 })
+
+	// First delivery plus one per retry
+	if got := calls.Load(); got != 3 {
+		t.Fatalf("expected 3 handler calls, got %d", got)
+	}
+
+	msg, _ := broker.Get(routing.VideoDLQueue)
+	if attempt := headerInt(msg.Headers, RetryAttemptHeader); attempt != 2 {
+		t.Fatalf("expected %s=2 on dead-lettered job, got %d", RetryAttemptHeader, attempt)
+	}
+}
+
+func TestRequeueLoopIsDivertedAsPoison(t *testing.T) {
+	broker := newVideoBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls atomic.Int32
+	_, err := SubscribeEnvelope(ctx, broker, routing.ExchangeVideoTopic, routing.VideoQueue, routing.VideoUploadKey, SimpleQueueQuorum, JSON,
+		func(job routing.VideoJob, env Envelope) AckType {
+			env.RecordError(fmt.Errorf("attempt %d failed", calls.Add(1)))
+			return NackRequeue
+		},
+		WithTopology(routing.VideoTopology),
+		WithPoisonLimit(3),
+	)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	if err := PublishJSON(broker, routing.ExchangeVideoTopic, routing.VideoUploadKey, routing.VideoJob{ID: "vid-poison"}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	waitFor(t, "job in failed queue", func() bool { return broker.QueueLen(routing.VideoDLQueue) == 1 })
+
+	if got := calls.Load(); got != 3 {
+		t.Fatalf("expected 3 handler calls, got %d", got)
+	}
+
+	msg, _ := broker.Get(routing.VideoDLQueue)
+	if reason := msg.Headers[DeadLetterReasonHeader]; reason != "poison" {
+		t.Fatalf("expected %s=poison, got %v", DeadLetterReasonHeader, reason)
+	}
+	if lastErr := msg.Headers[LastErrorHeader]; lastErr != "attempt 3 failed" {
+		t.Fatalf("expected last error from the final attempt, got %v", lastErr)
+	}
+	if deaths := Deaths(msg.Headers); len(deaths) != 1 || deaths[0].Queue != routing.VideoQueue {
+		t.Fatalf("unexpected x-death %+v", deaths)
+	}
+}
+
+func TestPublishDelayedArrivesAfterDelay(t *testing.T) {
+	broker := newVideoBroker(t)
+	if err := DeclareAndBind(broker, routing.ExchangeVideoTopic, "delayed_jobs", routing.VideoUploadKey, SimpleQueueDurable, nil); err != nil {
+		t.Fatalf("declare: %v", err)
+	}
+
+	start := time.Now()
+	err := PublishDelayed(context.Background(), broker, JSON, routing.ExchangeVideoTopic, routing.VideoUploadKey, routing.VideoJob{ID: "vid-later"}, time.Second)
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if n := broker.QueueLen("delayed_jobs"); n != 0 {
+		t.Fatalf("expected the job to wait, found %d in the queue", n)
+	}
+
+	waitFor(t, "delayed job", func() bool { return broker.QueueLen("delayed_jobs") == 1 })
+	if waited := time.Since(start); waited < time.Second {
+		t.Fatalf("job arrived after %s, before its delay", waited)
+	}
+
+	msg, _ := broker.Get("delayed_jobs")
+	if msg.RoutingKey != routing.VideoUploadKey {
+		t.Fatalf("expected routing key %s, got %s", routing.VideoUploadKey, msg.RoutingKey)
+	}
+	if attempts := DeliveryAttempts(msg, 0); attempts != 1 {
+		t.Fatalf("expected the delay not to count as an attempt, got %d", attempts)
+	}
+}
+
+func TestPublishDelayedRoundsUp(t *testing.T) {
+	broker := newVideoBroker(t)
+
+	err := PublishDelayed(context.Background(), broker, JSON, routing.ExchangeVideoTopic, routing.VideoUploadKey, routing.VideoJob{ID: "vid-later"}, 1100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	queue := DelayQueueName(routing.ExchangeVideoTopic, routing.VideoUploadKey, 2*time.Second)
+	if n := broker.QueueLen(queue); n != 1 {
+		t.Fatalf("expected the job to wait in %s, found %d there", queue, n)
+	}
+}
+
+func TestSubscriberMetrics(t *testing.T) {
+	broker := newVideoBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	queue := routing.VideoQueue
+	deliveries := testutil.ToFloat64(deliveriesTotal.WithLabelValues(queue))
+	acks := testutil.ToFloat64(outcomesTotal.WithLabelValues(queue, Ack.String()))
+	discards := testutil.ToFloat64(outcomesTotal.WithLabelValues(queue, NackDiscard.String()))
+	rejected := testutil.ToFloat64(deadLettersTotal.WithLabelValues(queue, "rejected"))
+
+	_, err := SubscribeJSON(ctx, broker, routing.ExchangeVideoTopic, queue, routing.VideoUploadKey, SimpleQueueQuorum,
+		func(job routing.VideoJob) AckType {
+			if job.ID == "bad" {
+				return NackDiscard
+			}
+			return Ack
+		},
+		WithTopology(routing.VideoTopology),
+	)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	for _, id := range []string{"good", "bad"} {
+		if err := PublishJSON(broker, routing.ExchangeVideoTopic, routing.VideoUploadKey, routing.VideoJob{ID: id}); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+	waitFor(t, "job in failed queue", func() bool { return broker.QueueLen(routing.VideoDLQueue) == 1 })
+
+	if got := testutil.ToFloat64(deliveriesTotal.WithLabelValues(queue)) - deliveries; got != 2 {
+		t.Fatalf("expected 2 deliveries, got %v", got)
+	}
+	if got := testutil.ToFloat64(outcomesTotal.WithLabelValues(queue, Ack.String())) - acks; got != 1 {
+		t.Fatalf("expected 1 ack, got %v", got)
+	}
+	if got := testutil.ToFloat64(outcomesTotal.WithLabelValues(queue, NackDiscard.String())) - discards; got != 1 {
+		t.Fatalf("expected 1 nack-discard, got %v", got)
+	}
+	if got := testutil.ToFloat64(deadLettersTotal.WithLabelValues(queue, "rejected")) - rejected; got != 1 {
+		t.Fatalf("expected 1 rejected dead letter, got %v", got)
+	}
+}
+
+func TestSubscriberUpcastsUnversionedJobs(t *testing.T) {
+	broker := newVideoBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	jobs := make(chan routing.VideoJob, 2)
+	_, err := SubscribeJSON(ctx, broker, routing.ExchangeVideoTopic, routing.VideoQueue, routing.VideoUploadKey, SimpleQueueQuorum,
+		func(job routing.VideoJob) AckType {
+			jobs <- job
+			return Ack
+		},
+		WithTopology(routing.VideoTopology),
+	)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	// What a build from before priorities and schema versions published
+	err = broker.Publish(ctx, routing.ExchangeVideoTopic, routing.VideoUploadKey, amqp.Publishing{
+		ContentType: "application/json",
+		Body:        []byte(`{"id":"vid-old","source_path":"s3://bucket/vid-old.mp4"}`),
+	})
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if err := PublishJSON(broker, routing.ExchangeVideoTopic, routing.VideoUploadKey, routing.VideoJob{ID: "vid-new", Priority: routing.PriorityHigh}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	// The new job may overtake the old one, so compare by ID
+	want := map[string]uint8{"vid-old": routing.PriorityNormal, "vid-new": routing.PriorityHigh}
+	for range want {
+		select {
+		case job := <-jobs:
+			if priority, ok := want[job.ID]; !ok || job.Priority != priority {
+				t.Fatalf("unexpected job %+v", job)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for jobs")
+		}
+	}
+}
+
+func TestSubscriberDecodesUnversionedGobJobs(t *testing.T) {
+	broker := newVideoBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	jobs := make(chan routing.VideoJob, 1)
+	_, err := SubscribeGob(ctx, broker, routing.ExchangeVideoTopic, routing.VideoQueue, routing.VideoUploadKey, SimpleQueueQuorum,
+		func(job routing.VideoJob) AckType {
+			jobs <- job
+			return Ack
+		},
+		WithTopology(routing.VideoTopology),
+	)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	// Gob matches fields by name, so this is what an older build sent
+	type oldVideoJob struct {
+		ID         string
+		SourcePath string
+	}
+	body, err := Gob.Marshal(oldVideoJob{ID: "vid-old", SourcePath: "s3://bucket/vid-old.mp4"})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	err = broker.Publish(ctx, routing.ExchangeVideoTopic, routing.VideoUploadKey, amqp.Publishing{
+		ContentType: Gob.ContentType(),
+		Body:        body,
+	})
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	select {
+	case job := <-jobs:
+		if job.ID != "vid-old" || job.SourcePath != "s3://bucket/vid-old.mp4" {
+			t.Fatalf("unexpected job %+v", job)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for the job, %d in the failed queue", broker.QueueLen(routing.VideoDLQueue))
+	}
+}
+
+func TestApplyTopologyRejectsChangedArguments(t *testing.T) {
+	broker := newVideoBroker(t)
+
+	// Applying the same topology again is a no-op
+	if err := ApplyTopology(broker, routing.VideoTopology); err != nil {
+		t.Fatalf("re-apply topology: %v", err)
+	}
+
+	err := DeclareAndBind(broker, routing.ExchangeVideoTopic, routing.VideoQueue, routing.VideoUploadKey, SimpleQueueDurable, nil)
+	if err == nil {
+		t.Fatal("expected redeclaring video_processing without its DLX to fail")
+	}
+}
+
+func TestQuorumDeliveryLimitDeadLetters(t *testing.T) {
+	broker := newVideoBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls atomic.Int32
+	_, err := SubscribeJSON(ctx, broker, routing.ExchangeVideoTopic, routing.VideoQueue, routing.VideoUploadKey, SimpleQueueQuorum,
+		func(job routing.VideoJob) AckType {
+			calls.Add(1)
+			return NackRequeue
+		},
+		WithTopology(routing.VideoTopology),
+	)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	if err := PublishJSON(broker, routing.ExchangeVideoTopic, routing.VideoUploadKey, routing.VideoJob{ID: "vid-4"}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	waitFor(t, "job in failed queue", func() bool { return broker.QueueLen(routing.VideoDLQueue) == 1 })
+
+	// First delivery plus one per allowed requeue
+	if got := calls.Load(); got != routing.VideoDeliveryLimit+1 {
+		t.Fatalf("expected %d handler calls, got %d", routing.VideoDeliveryLimit+1, got)
+	}
+
+	msg, _ := broker.Get(routing.VideoDLQueue)
+	if deaths := Deaths(msg.Headers); len(deaths) != 1 || deaths[0].Reason != "delivery_limit" {
+		t.Fatalf("unexpected x-death %+v", deaths)
+	}
+}
+
+func TestHighPriorityJobsOvertakeQueuedOnes(t *testing.T) {
+	broker := newVideoBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Queue some normal jobs before anyone is consuming, then one high priority job
+	for _, job := range []routing.VideoJob{
+		{ID: "long-1", Priority: routing.PriorityNormal},
+		{ID: "long-2", Priority: routing.PriorityNormal},
+		{ID: "clip", Priority: routing.PriorityHigh},
+	} {
+		if err := PublishJSON(broker, routing.ExchangeVideoTopic, routing.VideoUploadKey, job); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	order := make(chan string, 3)
+	_, err := SubscribeJSON(ctx, broker, routing.ExchangeVideoTopic, routing.VideoQueue, routing.VideoUploadKey, SimpleQueueQuorum,
+		func(job routing.VideoJob) AckType {
+			order <- job.ID
+			return Ack
+		},
+		WithTopology(routing.VideoTopology),
+	)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	for _, want := range []string{"clip", "long-1", "long-2"} {
+		select {
+		case got := <-order:
+			if got != want {
+				t.Fatalf("expected %s next, got %s", want, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+}
+
+func TestConcurrencyLimitsInFlight(t *testing.T) {
+	broker := newVideoBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var running, peak, handled atomic.Int32
+	release := make(chan struct{})
+
+	_, err := SubscribeJSON(ctx, broker, routing.ExchangeVideoTopic, routing.VideoQueue, routing.VideoUploadKey, SimpleQueueDurable,
+		func(job routing.VideoJob) AckType {
+			now := running.Add(1)
+			for {
+				old := peak.Load()
+				if now <= old || peak.CompareAndSwap(old, now) {
+					break
+				}
+			}
+			<-release
+			running.Add(-1)
+			handled.Add(1)
+			return Ack
+		},
+		WithTopology(routing.VideoTopology),
+		WithConcurrency(2),
+	)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := PublishJSON(broker, routing.ExchangeVideoTopic, routing.VideoUploadKey, routing.VideoJob{ID: "vid"}); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	waitFor(t, "two handlers running", func() bool { return running.Load() == 2 })
+	if n := broker.QueueLen(routing.VideoQueue); n != 3 {
+		t.Fatalf("expected 3 jobs still queued behind prefetch, got %d", n)
+	}
+
+	close(release)
+	waitFor(t, "all jobs handled", func() bool { return handled.Load() == 5 })
+	if peak.Load() != 2 {
+		t.Fatalf("expected at most 2 concurrent handlers, saw %d", peak.Load())
+	}
+}
+
+func TestHandlerTimeoutCancelsTheHandler(t *testing.T) {
+	broker := newVideoBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var stopped atomic.Bool
+	_, err := SubscribeEnvelope(ctx, broker, routing.ExchangeVideoTopic, routing.VideoQueue, routing.VideoUploadKey, SimpleQueueDurable, JSON,
+		func(job routing.VideoJob, env Envelope) AckType {
+			<-env.Context().Done()
+			stopped.Store(true)
+			return Ack
+		},
+		WithTopology(routing.VideoTopology),
+		WithHandlerTimeout(20*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	if err := PublishJSON(broker, routing.ExchangeVideoTopic, routing.VideoUploadKey, routing.VideoJob{ID: "vid-slow"}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	waitFor(t, "timed out job in failed queue", func() bool { return broker.QueueLen(routing.VideoDLQueue) == 1 })
+	if !stopped.Load() {
+		t.Fatal("expected the handler to have stopped before its message was dead-lettered")
+	}
+	msg, _ := broker.Get(routing.VideoDLQueue)
+	if reason := msg.Headers[DeadLetterReasonHeader]; reason != "rejected" {
+		t.Fatalf("expected the timed out job to be rejected, got %v", reason)
+	}
+}
+
+func TestMemoryStreamReplaysFromOffset(t *testing.T) {
+	broker := newVideoBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, id := range []string{"vid-1", "vid-2", "vid-3"} {
+		if err := PublishJSON(broker, routing.ExchangeVideoTopic, routing.VideoCancelKey, routing.VideoCancel{VideoID: id}); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+
+	// read subscribes at offset and returns what the reader has seen so far
+	read := func(offset StreamOffset) func() string {
+		var mu sync.Mutex
+		var seen []string
+		_, err := SubscribeStream(ctx, broker, routing.ExchangeVideoTopic, routing.VideoCancelStream, routing.VideoCancelKey, JSON, offset,
+			func(cancel routing.VideoCancel, position int64, env Envelope) error {
+				mu.Lock()
+				defer mu.Unlock()
+				seen = append(seen, fmt.Sprintf("%d:%s", position, cancel.VideoID))
+				return nil
+			},
+			WithTopology(routing.VideoTopology),
+		)
+		if err != nil {
+			t.Fatalf("subscribe at %v: %v", offset.arg(), err)
+		}
+		return func() string {
+			mu.Lock()
+			defer mu.Unlock()
+			return strings.Join(seen, ",")
+		}
+	}
+
+	// Every stream reader gets every message, so none of them steal from the others
+	first, at, next := read(StreamFirst), read(StreamAt(2)), read(StreamNext)
+	if err := PublishJSON(broker, routing.ExchangeVideoTopic, routing.VideoCancelKey, routing.VideoCancel{VideoID: "vid-4"}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		seen func() string
+		want string
+	}{
+		{"first", first, "0:vid-1,1:vid-2,2:vid-3,3:vid-4"},
+		{"at 2", at, "2:vid-3,3:vid-4"},
+		{"next", next, "3:vid-4"},
+	} {
+		waitFor(t, "stream reader "+tc.name, func() bool { return len(tc.seen()) >= len(tc.want) })
+		if got := tc.seen(); got != tc.want {
+			t.Errorf("reader at %s: expected %s, got %s", tc.name, tc.want, got)
+		}
+	}
+	if n := broker.QueueLen(routing.VideoCancelStream); n != 4 {
+		t.Fatalf("expected the stream to keep all 4 messages, got %d", n)
+	}
+}
+
+func TestCallKeepsTheCallersCorrelationID(t *testing.T) {
+	broker := newVideoBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := Serve(ctx, broker, routing.ExchangeVideoTopic, routing.VideoProbeQueue, routing.VideoProbeKey, SimpleQueueDurable, JSON,
+		func(ctx context.Context, req routing.ProbeRequest, env Envelope) (routing.ProbeResult, error) {
+			if env.CorrelationID != "corr-upload" {
+				return routing.ProbeResult{}, fmt.Errorf("request arrived with correlation %q", env.CorrelationID)
+			}
+			if len(req.VideoID) != len("vid-1") {
+				return routing.ProbeResult{}, fmt.Errorf("unexpected video %q", req.VideoID)
+			}
+			return routing.ProbeResult{DurationSeconds: float64(req.VideoID[len(req.VideoID)-1] - '0')}, nil
+		},
+		WithTopology(routing.VideoTopology),
+	)
+	if err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+
+	// Two calls made for the same request share its correlation ID and must still get their own replies
+	callCtx := ContextWithEnvelope(ctx, Envelope{CorrelationID: "corr-upload"})
+	var wg sync.WaitGroup
+	for _, id := range []string{"vid-1", "vid-2"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := Call[routing.ProbeRequest, routing.ProbeResult](callCtx, broker, JSON, routing.ExchangeVideoTopic, routing.VideoProbeKey, routing.ProbeRequest{VideoID: id})
+			if err != nil {
+				t.Errorf("call for %s: %v", id, err)
+				return
+			}
+			if want := float64(id[len(id)-1] - '0'); result.DurationSeconds != want {
+				t.Errorf("call for %s got the reply for another call: %+v", id, result)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPoisonStepIsDeadLettered(t *testing.T) {
+	broker := newVideoBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls atomic.Int32
+	queue, key := routing.StepQueue(routing.StepProbe), routing.StepKey(routing.StepProbe)
+	_, err := SubscribeEnvelope(ctx, broker, routing.ExchangeVideoTopic, queue, key, SimpleQueueQuorum, JSON,
+		func(task routing.StepTask, env Envelope) AckType {
+			calls.Add(1)
+			return NackRequeue
+		},
+		WithTopology(routing.VideoTopology),
+		WithPoisonLimit(3),
+	)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	if err := PublishJSON(broker, routing.ExchangeVideoTopic, key, routing.StepTask{RunID: "run-1", Step: "probe", Kind: routing.StepProbe}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	// The handler never sees it, so only the failed queue can tell anyone about it
+	if err := broker.Publish(ctx, routing.ExchangeVideoTopic, key, amqp.Publishing{ContentType: "application/json", Body: []byte("{")}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	waitFor(t, "steps in failed queue", func() bool { return broker.QueueLen(routing.VideoDLQueue) == 2 })
+	if got := calls.Load(); got != 3 {
+		t.Fatalf("expected 3 handler calls, got %d", got)
+	}
+
+	reasons := map[any]bool{}
+	for range 2 {
+		msg, _ := broker.Get(routing.VideoDLQueue)
+		reasons[msg.Headers[DeadLetterReasonHeader]] = true
+		if msg.RoutingKey != key {
+			t.Errorf("expected the step to keep its routing key %s, got %s", key, msg.RoutingKey)
+		}
+	}
+	if !reasons["poison"] || !reasons["undecodable"] {
+		t.Fatalf("expected a poison and an undecodable step, got %v", reasons)
+	}
+}
@@ -0,0 +1,114 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Metrics are registered with the default Prometheus registry, so serving
+// promhttp.Handler() on /metrics exposes them. Labels are limited to the
+// exchange or queue, never routing keys or message IDs.
+var (
+	publishedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pubsub",
+		Name:      "published_total",
+		Help:      "Messages confirmed by the broker, by exchange.",
+	}, []string{"exchange"})
+
+	publishFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pubsub",
+		Name:      "publish_failures_total",
+		Help:      "Publishes that were not confirmed, by exchange and reason (unroutable, nacked, timeout, closed, error).",
+	}, []string{"exchange", "reason"})
+
+	publishDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "pubsub",
+		Name:      "publish_duration_seconds",
+		Help:      "Time from publish until the broker confirmed or refused it.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"exchange"})
+
+	deliveriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pubsub",
+		Name:      "deliveries_total",
+		Help:      "Messages received by subscribers, by queue.",
+	}, []string{"queue"})
+
+	outcomesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pubsub",
+		Name:      "handler_outcomes_total",
+		Help:      "What handlers returned, by queue and ack type (ack, nack-requeue, nack-discard, nack-retry; error for stream handlers).",
+	}, []string{"queue", "ack"})
+
+	decodeFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pubsub",
+		Name:      "decode_failures_total",
+		Help:      "Deliveries whose body could not be decoded, by queue.",
+	}, []string{"queue"})
+
+	deadLettersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pubsub",
+		Name:      "dead_letters_total",
+		Help:      "Messages a subscriber gave up on, by queue and reason (rejected, retries-exhausted, poison, undecodable).",
+	}, []string{"queue", "reason"})
+
+	handlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "pubsub",
+		Name:      "handler_duration_seconds",
+		Help:      "Time spent in the handler, middleware included, by queue.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 4, 10),
+	}, []string{"queue"})
+
+	endToEndLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "pubsub",
+		Name:      "end_to_end_latency_seconds",
+		Help:      "Time from the message timestamp until its handler finished, by queue.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 4, 10),
+	}, []string{"queue"})
+)
+
+func exchangeLabel(exchange string) string {
+	if exchange == "" {
+		return "(default)"
+	}
+	return exchange
+}
+
+func observePublish(exchange string, start time.Time, err error) {
+	exchange = exchangeLabel(exchange)
+	publishDuration.WithLabelValues(exchange).Observe(time.Since(start).Seconds())
+	if err == nil {
+		publishedTotal.WithLabelValues(exchange).Inc()
+		return
+	}
+	publishFailuresTotal.WithLabelValues(exchange, publishFailureReason(err)).Inc()
+}
+
+func publishFailureReason(err error) string {
+	switch {
+	case errors.Is(err, ErrUnroutable):
+		return "unroutable"
+	case errors.Is(err, ErrPublishNacked):
+		return "nacked"
+	case errors.Is(err, ErrConfirmTimeout), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, ErrChannelClosed):
+		return "closed"
+	default:
+		return "error"
+	}
+}
+
+// observeHandled records a finished handler call for a delivery from queue.
+func observeHandled(queue string, msg amqp.Delivery, start time.Time, outcome string) {
+	handlerDuration.WithLabelValues(queue).Observe(time.Since(start).Seconds())
+	outcomesTotal.WithLabelValues(queue, outcome).Inc()
+	if !msg.Timestamp.IsZero() {
+		endToEndLatency.WithLabelValues(queue).Observe(time.Since(msg.Timestamp).Seconds())
+	}
+}
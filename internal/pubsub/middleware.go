@@ -0,0 +1,118 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"runtime/debug"
+	"time"
+)
+
+// Handler is the full form of a subscriber callback; func(T) AckType
+// handlers are adapted to it by Subscribe.
+type Handler[T any] func(T, Envelope) AckType
+
+// Middleware wraps a Handler to add behaviour before and after it runs.
+type Middleware[T any] func(next Handler[T]) Handler[T]
+
+// Chain wraps handler so the first middleware is the outermost one.
+func Chain[T any](handler Handler[T], middleware ...Middleware[T]) Handler[T] {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+func (a AckType) String() string {
+	switch a {
+	case Ack:
+		return "ack"
+	case NackRequeue:
+		return "nack-requeue"
+	case NackDiscard:
+		return "nack-discard"
+	case NackRetry:
+		return "nack-retry"
+	default:
+		return fmt.Sprintf("AckType(%d)", int(a))
+	}
+}
+
+// Recover turns a panicking handler into a NackDiscard so the message goes
+// to the DLX and the consumer keeps running.
+func Recover[T any]() Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(val T, env Envelope) (ackType AckType) {
+			defer func() {
+				if p := recover(); p != nil {
+					log.Printf("Handler panicked on message %s: %v\n%s", env.MessageID, p, debug.Stack())
+					env.RecordError(fmt.Errorf("panic: %v", p))
+					ackType = NackDiscard
+				}
+			}()
+			return next(val, env)
+		}
+	}
+}
+
+// Logging writes one structured line when a message arrives and one with the
+// outcome and duration when the handler returns.
+func Logging[T any](logger *slog.Logger) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(val T, env Envelope) AckType {
+			msgLog := logger.With(
+				"message_id", env.MessageID,
+				"correlation_id", env.CorrelationID,
+				"trace_id", env.TraceID(),
+				"routing_key", env.RoutingKey,
+			)
+			msgLog.Info("message received", "redelivered", env.Redelivered, "app_id", env.AppID)
+
+			start := time.Now()
+			ackType := next(val, env)
+
+			level := slog.LevelInfo
+			if ackType != Ack {
+				level = slog.LevelWarn
+			}
+			msgLog.Log(context.Background(), level, "message handled", "ack", ackType.String(), "duration", time.Since(start))
+			return ackType
+		}
+	}
+}
+
+// Timing reports how long each handler call took and what it returned.
+func Timing[T any](observe func(env Envelope, duration time.Duration, ackType AckType)) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(val T, env Envelope) AckType {
+			start := time.Now()
+			ackType := next(val, env)
+			observe(env, time.Since(start), ackType)
+			return ackType
+		}
+	}
+}
+
+// Timeout dead-letters a message whose handler is still running after d. It
+// cancels the handler's env.Context() at that point and waits for the
+// handler to return before settling the message, so the work never carries
+// on behind a retry. A handler that ignores the context therefore only
+// times out once it returns on its own.
+func Timeout[T any](d time.Duration) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(val T, env Envelope) AckType {
+			ctx, cancel := context.WithTimeout(env.Context(), d)
+			defer cancel()
+
+			ackType := next(val, env.WithContext(ctx))
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				log.Printf("Handler exceeded %s on message %s, dead-lettering it", d, env.MessageID)
+				env.RecordError(fmt.Errorf("handler timed out after %s", d))
+				return NackDiscard
+			}
+			return ackType
+		}
+	}
+}
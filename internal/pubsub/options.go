@@ -0,0 +1,113 @@
+package pubsub
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/JerryG0311/Vidify/internal/routing"
+)
+
+type subscribeOptions struct {
+	prefetch       int
+	concurrency    int
+	handlerTimeout time.Duration
+	retry          RetryPolicy
+	middleware     []any // Middleware[T], checked against T in subscribe
+	topology       routing.Topology
+	poisonLimit    int
+}
+
+type SubscribeOption func(*subscribeOptions)
+
+// WithPrefetch sets the channel Qos. Defaults to the concurrency so every
+// handler goroutine has one message ready.
+func WithPrefetch(count int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.prefetch = count
+	}
+}
+
+// WithConcurrency sets how many handler goroutines process deliveries in parallel.
+func WithConcurrency(workers int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.concurrency = workers
+	}
+}
+
+// WithHandlerTimeout dead-letters a message whose handler runs longer than d,
+// cancelling its env.Context(). It is the Timeout middleware applied closest
+// to the handler.
+func WithHandlerTimeout(d time.Duration) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.handlerTimeout = d
+	}
+}
+
+// WithRetry declares the delayed retry queues for the subscription and
+// enables the NackRetry ack type.
+func WithRetry(policy RetryPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.retry = policy
+	}
+}
+
+// WithMiddleware wraps the subscription's handler, first middleware outermost.
+// T must match the subscription's message type.
+func WithMiddleware[T any](middleware ...Middleware[T]) SubscribeOption {
+	return func(o *subscribeOptions) {
+		for _, mw := range middleware {
+			o.middleware = append(o.middleware, mw)
+		}
+	}
+}
+
+// WithTopology declares the subscription's queue with the arguments (DLX,
+// TTL, queue type) it has in topology, so it matches what ApplyTopology
+// declared. Without it the queue is declared with no arguments.
+func WithTopology(topology routing.Topology) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.topology = topology
+	}
+}
+
+// WithPoisonLimit dead-letters a message once it has been delivered limit
+// times, counting requeues, retries and earlier dead-letterings, instead of
+// handing it to the handler again. Defaults to DefaultPoisonLimit; a negative
+// limit turns the check off.
+func WithPoisonLimit(limit int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.poisonLimit = limit
+	}
+}
+
+func newSubscribeOptions(opts []SubscribeOption) subscribeOptions {
+	options := subscribeOptions{concurrency: 1, poisonLimit: DefaultPoisonLimit}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if options.concurrency < 1 {
+		options.concurrency = 1
+	}
+	if options.prefetch < 1 {
+		options.prefetch = options.concurrency
+	}
+	return options
+}
+
+func buildHandler[T any](handler Handler[T], options subscribeOptions) (Handler[T], error) {
+	chain := make([]Middleware[T], 0, len(options.middleware)+1)
+	for _, raw := range options.middleware {
+		mw, ok := raw.(Middleware[T])
+		if !ok {
+			var zero T
+			return nil, fmt.Errorf("pubsub: %T cannot wrap a handler for %T", raw, zero)
+		}
+		chain = append(chain, mw)
+	}
+
+	if options.handlerTimeout > 0 {
+		chain = append(chain, Timeout[T](options.handlerTimeout))
+	}
+	return Chain(handler, chain...), nil
+}
@@ -0,0 +1,195 @@
+package pubsub
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	DefaultRelayInterval = time.Second
+	outboxBatchSize      = 100
+	// A row that fails this many publishes is parked so later rows can go out
+	outboxMaxAttempts = 10
+	// Sent rows are kept this long for debugging, then pruned
+	outboxRetention = 7 * 24 * time.Hour
+)
+
+// Outbox stores outgoing messages in the outbox table inside the caller's
+// database transaction, so a message exists exactly when the rows it
+// describes were committed. Relay publishes them afterwards.
+type Outbox struct {
+	db   *sql.DB
+	wake chan struct{}
+}
+
+func NewOutbox(db *sql.DB) *Outbox {
+	return &Outbox{db: db, wake: make(chan struct{}, 1)}
+}
+
+// Enqueue encodes val and stamps its envelope exactly like Publish, but
+// writes it to the outbox with tx instead of sending it.
+func Enqueue[T any](
+	ctx context.Context,
+	tx *sql.Tx,
+	codec Codec,
+	exchange,
+	routingKey string,
+	val T,
+) error {
+	msg, err := newPublishing(ctx, codec, val)
+	if err != nil {
+		return err
+	}
+
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO outbox (message_id, exchange, routing_key, content_type, correlation_id, headers, priority, body, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		msg.MessageId, exchange, routingKey, msg.ContentType, msg.CorrelationId, string(headers), msg.Priority, msg.Body, msg.Timestamp,
+	)
+	return err
+}
+
+// Notify wakes the relay after a commit so the message goes out now rather
+// than on the next tick.
+func (o *Outbox) Notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Relay publishes pending outbox rows in order, waiting for each confirm
+// before marking the row sent, until ctx is cancelled. A failed publish
+// stops the batch so later messages never overtake it; the row is retried
+// on the next tick. A row that can never be sent (unroutable or too large)
+// or has failed outboxMaxAttempts times is parked with failed_at instead, so
+// one bad message cannot hold up every other. A crash between confirm and
+// update sends the message again, which consumers already tolerate.
+func (o *Outbox) Relay(ctx context.Context, broker Broker, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastPrune := time.Time{}
+	for {
+		if err := o.relayBatch(ctx, broker); err != nil && ctx.Err() == nil {
+			log.Printf("Outbox relay: %v", err)
+		}
+
+		if time.Since(lastPrune) > time.Hour {
+			o.prune()
+			lastPrune = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+type outboxRow struct {
+	id            int64
+	messageID     string
+	exchange      string
+	routingKey    string
+	contentType   string
+	correlationID string
+	headers       string
+	priority      uint8
+	body          []byte
+	createdAt     time.Time
+	attempts      int
+}
+
+// permanentPublishError reports whether publishing a message again cannot
+// succeed: nothing is bound for it, or it is too large to send.
+func permanentPublishError(err error) bool {
+	return errors.Is(err, ErrUnroutable) || errors.Is(err, ErrMessageTooLarge)
+}
+
+func (o *Outbox) relayBatch(ctx context.Context, broker Broker) error {
+	rows, err := o.pending(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		headers := amqp.Table{}
+		if err := json.Unmarshal([]byte(row.headers), &headers); err != nil {
+			log.Printf("Outbox message %s has unreadable headers, sending without them: %v", row.messageID, err)
+		}
+
+		msg := amqp.Publishing{
+			ContentType:   row.contentType,
+			MessageId:     row.messageID,
+			CorrelationId: row.correlationID,
+			Timestamp:     row.createdAt,
+			AppId:         AppID,
+			Headers:       headers,
+			Priority:      row.priority,
+			Body:          row.body,
+		}
+
+		if err := broker.Publish(ctx, row.exchange, row.routingKey, msg); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			if permanentPublishError(err) || row.attempts+1 >= outboxMaxAttempts {
+				if _, dbErr := o.db.Exec("UPDATE outbox SET attempts = attempts + 1, last_error = ?, failed_at = ? WHERE id = ?", err.Error(), time.Now().UTC(), row.id); dbErr != nil {
+					return dbErr
+				}
+				log.Printf("Outbox message %s to %s/%s parked after %d attempt(s): %v", row.messageID, row.exchange, row.routingKey, row.attempts+1, err)
+				continue
+			}
+			if _, dbErr := o.db.Exec("UPDATE outbox SET attempts = attempts + 1, last_error = ? WHERE id = ?", err.Error(), row.id); dbErr != nil {
+				log.Printf("Failed to record outbox error for message %s: %v", row.messageID, dbErr)
+			}
+			return err
+		}
+
+		if _, err := o.db.Exec("UPDATE outbox SET sent_at = ?, attempts = attempts + 1, last_error = '' WHERE id = ?", time.Now().UTC(), row.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Outbox) pending(ctx context.Context) ([]outboxRow, error) {
+	rows, err := o.db.QueryContext(ctx,
+		"SELECT id, message_id, exchange, routing_key, content_type, correlation_id, headers, priority, body, created_at, attempts FROM outbox WHERE sent_at IS NULL AND failed_at IS NULL ORDER BY id LIMIT ?",
+		outboxBatchSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []outboxRow
+	for rows.Next() {
+		var row outboxRow
+		if err := rows.Scan(&row.id, &row.messageID, &row.exchange, &row.routingKey, &row.contentType, &row.correlationID, &row.headers, &row.priority, &row.body, &row.createdAt, &row.attempts); err != nil {
+			return nil, err
+		}
+		pending = append(pending, row)
+	}
+	return pending, rows.Err()
+}
+
+func (o *Outbox) prune() {
+	cutoff := time.Now().UTC().Add(-outboxRetention)
+	if _, err := o.db.Exec("DELETE FROM outbox WHERE sent_at IS NOT NULL AND sent_at < ?", cutoff); err != nil {
+		log.Printf("Failed to prune outbox: %v", err)
+	}
+}
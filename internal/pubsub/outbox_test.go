@@ -0,0 +1,94 @@
+package pubsub
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/JerryG0311/Vidify/internal/routing"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newOutboxDB returns an in-memory database with the outbox migrations from
+// sql/schema applied.
+func newOutboxDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	for _, name := range []string{
+		"20260322000100_create_outbox.sql",
+		"20260322000200_add_priority_to_outbox.sql",
+		"20260322000800_add_failed_at_to_outbox.sql",
+	} {
+		migration, err := os.ReadFile(filepath.Join("..", "..", "sql", "schema", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		up, _, _ := strings.Cut(string(migration), "-- +goose Down")
+		if _, err := db.Exec(up); err != nil {
+			t.Fatalf("apply %s: %v", name, err)
+		}
+	}
+	return db
+}
+
+func TestUnroutableOutboxRowDoesNotBlockLaterRows(t *testing.T) {
+	ctx := context.Background()
+	broker := newVideoBroker(t)
+	db := newOutboxDB(t)
+	outbox := NewOutbox(db)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Enqueue(ctx, tx, JSON, routing.ExchangeVideoTopic, "video.nowhere", routing.VideoJob{ID: "vid-lost"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Enqueue(ctx, tx, JSON, routing.ExchangeVideoTopic, routing.VideoUploadKey, routing.VideoJob{ID: "vid-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := outbox.relayBatch(ctx, broker); err != nil {
+		t.Fatalf("relay: %v", err)
+	}
+
+	if n := broker.QueueLen(routing.VideoQueue); n != 1 {
+		t.Fatalf("expected the routable job to be published past the unroutable one, %d in %s", n, routing.VideoQueue)
+	}
+
+	var parked, sent int
+	var lastError string
+	if err := db.QueryRow("SELECT COUNT(*) FROM outbox WHERE failed_at IS NOT NULL AND sent_at IS NULL").Scan(&parked); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM outbox WHERE sent_at IS NOT NULL").Scan(&sent); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT last_error FROM outbox WHERE routing_key = 'video.nowhere'").Scan(&lastError); err != nil {
+		t.Fatal(err)
+	}
+	if parked != 1 || sent != 1 || !strings.Contains(lastError, "not routed") {
+		t.Fatalf("expected 1 parked and 1 sent row, got %d parked, %d sent, last error %q", parked, sent, lastError)
+	}
+
+	// Parked rows are not picked up again
+	if err := outbox.relayBatch(ctx, broker); err != nil {
+		t.Fatalf("second relay: %v", err)
+	}
+	if n := broker.QueueLen(routing.VideoQueue); n != 1 {
+		t.Fatalf("expected nothing more to be published, %d in %s", n, routing.VideoQueue)
+	}
+}
@@ -0,0 +1,280 @@
+package pubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// ClaimCheckHeader holds the BlobStore reference of an offloaded body.
+	ClaimCheckHeader = "x-claim-check"
+	// restoreErrorHeader marks a delivery PayloadBroker could not restore,
+	// so the subscription dead-letters it as it is.
+	restoreErrorHeader = "x-restore-error"
+
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+
+	DefaultCompressAbove = 32 << 10
+	DefaultOffloadAbove  = 1 << 20
+	// RabbitMQ 4 rejects messages over 16MB unless max_message_size is raised
+	DefaultMaxMessageSize = 16 << 20
+
+	blobFetchAttempts = 3
+)
+
+var ErrMessageTooLarge = errors.New("pubsub: message body over the size limit")
+
+// BlobStore keeps message bodies that are too large to send through the
+// broker. Put returns a reference that Get accepts. Bodies are never
+// deleted by PayloadBroker, since a message can be routed to several
+// queues and streams; stores should expire them instead.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte) (ref string, err error)
+	Get(ctx context.Context, ref string) ([]byte, error)
+}
+
+// PayloadPolicy says when a body is compressed or offloaded. Zero
+// thresholds disable that step.
+type PayloadPolicy struct {
+	CompressAbove int
+	Compression   string // CompressionGzip or CompressionZstd
+	OffloadAbove  int
+	// Bodies still larger than MaxSize after compression are refused, unless
+	// Store is set and they are offloaded instead.
+	MaxSize int
+	Store   BlobStore
+}
+
+// DefaultPayloadPolicy compresses bodies over 32KB with zstd and offloads
+// anything still over 1MB to store.
+func DefaultPayloadPolicy(store BlobStore) PayloadPolicy {
+	return PayloadPolicy{
+		CompressAbove: DefaultCompressAbove,
+		Compression:   CompressionZstd,
+		OffloadAbove:  DefaultOffloadAbove,
+		MaxSize:       DefaultMaxMessageSize,
+		Store:         store,
+	}
+}
+
+// PayloadBroker wraps a Broker so large bodies never travel through
+// RabbitMQ: mid-sized ones are compressed (ContentEncoding), big ones are
+// stored in a BlobStore and replaced by a reference in ClaimCheckHeader
+// (the claim-check pattern). Deliveries from Consume are restored before
+// handlers see them, so publishers and subscribers need no changes.
+type PayloadBroker struct {
+	Broker
+	policy PayloadPolicy
+}
+
+func NewPayloadBroker(inner Broker, policy PayloadPolicy) *PayloadBroker {
+	return &PayloadBroker{Broker: inner, policy: policy}
+}
+
+func (p *PayloadBroker) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	msg, err := p.pack(ctx, msg)
+	if err != nil {
+		return err
+	}
+	return p.Broker.Publish(ctx, exchange, key, msg)
+}
+
+func (p *PayloadBroker) Consume(ctx context.Context, queueName, consumerTag string, prefetch int) (<-chan amqp.Delivery, error) {
+	msgs, err := p.Broker.Consume(ctx, queueName, consumerTag, prefetch)
+	if err != nil {
+		return nil, err
+	}
+	return p.unpackAll(ctx, queueName, msgs), nil
+}
+
+// ConsumeStream makes a PayloadBroker a StreamBroker when the wrapped one is.
+func (p *PayloadBroker) ConsumeStream(ctx context.Context, streamName, consumerTag string, prefetch int, offset StreamOffset) (<-chan amqp.Delivery, error) {
+	streams, ok := p.Broker.(StreamBroker)
+	if !ok {
+		return nil, fmt.Errorf("pubsub: %T does not support streams", p.Broker)
+	}
+	msgs, err := streams.ConsumeStream(ctx, streamName, consumerTag, prefetch, offset)
+	if err != nil {
+		return nil, err
+	}
+	return p.unpackAll(ctx, streamName, msgs), nil
+}
+
+func (p *PayloadBroker) pack(ctx context.Context, msg amqp.Publishing) (amqp.Publishing, error) {
+	if _, ok := msg.Headers[ClaimCheckHeader]; ok || msg.ContentEncoding != "" {
+		// Already packed, e.g. a dead letter being replayed
+		return msg, nil
+	}
+
+	if p.policy.CompressAbove > 0 && len(msg.Body) > p.policy.CompressAbove {
+		compressed, err := compress(p.policy.Compression, msg.Body)
+		if err != nil {
+			return msg, err
+		}
+		if len(compressed) < len(msg.Body) {
+			msg.Body = compressed
+			msg.ContentEncoding = p.policy.Compression
+		}
+	}
+
+	offload := p.policy.OffloadAbove > 0 && len(msg.Body) > p.policy.OffloadAbove
+	if !offload && p.policy.MaxSize > 0 && len(msg.Body) > p.policy.MaxSize {
+		offload = true
+	}
+	if !offload {
+		return msg, nil
+	}
+	if p.policy.Store == nil {
+		return msg, fmt.Errorf("%w: %d bytes and no blob store to offload to", ErrMessageTooLarge, len(msg.Body))
+	}
+
+	ref, err := p.policy.Store.Put(ctx, NewMessageID(), msg.Body)
+	if err != nil {
+		return msg, fmt.Errorf("pubsub: offload message body: %w", err)
+	}
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[ClaimCheckHeader] = ref
+	msg.Headers = headers
+	msg.Body = nil
+	return msg, nil
+}
+
+func (p *PayloadBroker) unpackAll(ctx context.Context, queueName string, msgs <-chan amqp.Delivery) <-chan amqp.Delivery {
+	out := make(chan amqp.Delivery)
+	go func() {
+		defer close(out)
+		for msg := range msgs {
+			resolved, err := p.unpack(ctx, msg)
+			if err != nil && ctx.Err() != nil {
+				// Shutting down, not a bad message
+				msg.Nack(false, true)
+				continue
+			}
+			if err != nil {
+				log.Printf("Could not restore message %s on %s, dead-lettering it: %v", msg.MessageId, queueName, err)
+				resolved = markUnrestorable(msg, err)
+			}
+			out <- resolved
+		}
+	}()
+	return out
+}
+
+// markUnrestorable passes msg on still packed, with the error in a header
+// the subscription checks before decoding.
+func markUnrestorable(msg amqp.Delivery, err error) amqp.Delivery {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[restoreErrorHeader] = err.Error()
+	msg.Headers = headers
+	return msg
+}
+
+func (p *PayloadBroker) unpack(ctx context.Context, msg amqp.Delivery) (amqp.Delivery, error) {
+	return RestorePayload(ctx, p.policy.Store, msg)
+}
+
+// RestorePayload undoes PayloadBroker on a raw delivery: it fetches a
+// claim-checked body from store and decompresses it. Tools reading queues
+// directly (like the dlq command) use it to see the original body.
+func RestorePayload(ctx context.Context, store BlobStore, msg amqp.Delivery) (amqp.Delivery, error) {
+	if ref, ok := msg.Headers[ClaimCheckHeader].(string); ok {
+		if store == nil {
+			return msg, fmt.Errorf("claim check %s but no blob store configured", ref)
+		}
+		body, err := fetchBlob(ctx, store, ref)
+		if err != nil {
+			return msg, err
+		}
+		msg.Body = body
+	}
+
+	if msg.ContentEncoding != "" {
+		body, err := decompress(msg.ContentEncoding, msg.Body)
+		if err != nil {
+			return msg, err
+		}
+		msg.Body = body
+		msg.ContentEncoding = ""
+	}
+	return msg, nil
+}
+
+func fetchBlob(ctx context.Context, store BlobStore, ref string) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt < blobFetchAttempts; attempt++ {
+		var body []byte
+		if body, err = store.Get(ctx, ref); err == nil {
+			return body, nil
+		}
+
+		select {
+		case <-time.After(backoff(attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, fmt.Errorf("fetch claim check %s: %w", ref, err)
+}
+
+func compress(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case CompressionGzip:
+		w = gzip.NewWriter(&buf)
+	case CompressionZstd:
+		enc, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		w = enc
+	default:
+		return nil, fmt.Errorf("pubsub: unknown compression %q", encoding)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case CompressionZstd:
+		r, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("pubsub: unknown content encoding %q", encoding)
+	}
+}
@@ -0,0 +1,141 @@
+package pubsub
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/JerryG0311/Vidify/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type memoryBlobs struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (m *memoryBlobs) Put(ctx context.Context, key string, data []byte) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[key] = append([]byte(nil), data...)
+	return "mem://" + key, nil
+}
+
+func (m *memoryBlobs) Get(ctx context.Context, ref string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.blobs[strings.TrimPrefix(ref, "mem://")], nil
+}
+
+func TestPayloadBrokerCompressesAndOffloads(t *testing.T) {
+	inner := newVideoBroker(t)
+	blobs := &memoryBlobs{blobs: map[string][]byte{}}
+	broker := NewPayloadBroker(inner, PayloadPolicy{
+		CompressAbove: 1 << 10,
+		Compression:   CompressionGzip,
+		OffloadAbove:  4 << 10,
+		Store:         blobs,
+	})
+
+	if err := DeclareAndBind(broker, routing.ExchangeVideoTopic, "payloads", "payload.#", SimpleQueueDurable, nil); err != nil {
+		t.Fatalf("declare: %v", err)
+	}
+
+	// Hex of random bytes compresses to half at best, so the big one stays over the offload limit
+	cases := []struct {
+		name     string
+		data     string
+		encoding string
+		offload  bool
+	}{
+		{"small", "s3://bucket/clip.mp4", "", false},
+		{"compressed", strings.Repeat("x", 2<<10), CompressionGzip, false},
+		{"offloaded", randomHex(1 << 19), "", true},
+	}
+
+	for _, tc := range cases {
+		job := routing.VideoJob{ID: tc.name, SourcePath: tc.data}
+		if err := PublishJSON(broker, routing.ExchangeVideoTopic, "payload."+tc.name, job); err != nil {
+			t.Fatalf("%s: publish: %v", tc.name, err)
+		}
+
+		raw, _ := inner.Get("payloads")
+		if !tc.offload && raw.ContentEncoding != tc.encoding {
+			t.Errorf("%s: expected encoding %q on the wire, got %q", tc.name, tc.encoding, raw.ContentEncoding)
+		}
+		if _, ok := raw.Headers[ClaimCheckHeader]; ok != tc.offload {
+			t.Errorf("%s: expected claim check %v, headers %v", tc.name, tc.offload, raw.Headers)
+		}
+
+		restored, err := RestorePayload(context.Background(), blobs, raw)
+		if err != nil {
+			t.Fatalf("%s: restore: %v", tc.name, err)
+		}
+		if !strings.Contains(string(restored.Body), job.SourcePath) {
+			t.Errorf("%s: restored body does not match what was published", tc.name)
+		}
+	}
+
+	// Subscribers see the original body without doing anything
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan routing.VideoJob, 1)
+	_, err := SubscribeJSON(ctx, broker, routing.ExchangeVideoTopic, "payloads", "payload.#", SimpleQueueDurable,
+		func(job routing.VideoJob) AckType {
+			got <- job
+			return Ack
+		})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	big := routing.VideoJob{ID: "big", SourcePath: randomHex(1 << 19)}
+	if err := PublishJSON(broker, routing.ExchangeVideoTopic, "payload.big", big); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if job := <-got; job.ID != big.ID || job.SourcePath != big.SourcePath {
+		t.Fatalf("subscriber got a different job back")
+	}
+}
+
+func TestUnrestorableMessageIsDeadLettered(t *testing.T) {
+	inner := newVideoBroker(t)
+	broker := NewPayloadBroker(inner, DefaultPayloadPolicy(&memoryBlobs{blobs: map[string][]byte{}}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	queue, key := routing.StepQueue(routing.StepProbe), routing.StepKey(routing.StepProbe)
+	_, err := SubscribeJSON(ctx, broker, routing.ExchangeVideoTopic, queue, key, SimpleQueueQuorum,
+		func(task routing.StepTask) AckType {
+			t.Errorf("handler got a message that could not be restored")
+			return Ack
+		},
+		WithTopology(routing.VideoTopology),
+	)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+
+	err = inner.Publish(ctx, routing.ExchangeVideoTopic, key, amqp.Publishing{
+		ContentType:     "application/json",
+		ContentEncoding: CompressionGzip,
+		Body:            []byte("not gzip"),
+	})
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	waitFor(t, "message in failed queue", func() bool { return inner.QueueLen(routing.VideoDLQueue) == 1 })
+	msg, _ := inner.Get(routing.VideoDLQueue)
+	if msg.Headers[DeadLetterReasonHeader] != "undecodable" {
+		t.Errorf("expected reason undecodable, got %v", msg.Headers[DeadLetterReasonHeader])
+	}
+	if _, ok := msg.Headers[restoreErrorHeader]; ok {
+		t.Errorf("expected the restore marker to be dropped, headers %v", msg.Headers)
+	}
+	// Left packed, so the dlq command can try again once the cause is fixed
+	if msg.ContentEncoding != CompressionGzip || string(msg.Body) != "not gzip" {
+		t.Errorf("expected the body dead-lettered as it was, got %q (%s)", msg.Body, msg.ContentEncoding)
+	}
+}
@@ -0,0 +1,152 @@
+package pubsub
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// LastErrorHeader holds the error recorded by the handler's last attempt.
+	LastErrorHeader = "x-last-error"
+	// DeadLetterReasonHeader says why the subscriber gave up on a message:
+	// "rejected", "retries-exhausted", "poison" or "undecodable".
+	DeadLetterReasonHeader = "x-dead-letter-reason"
+	// DeliveryAttemptsHeader is how many times the message had been handled
+	// when it was dead-lettered.
+	DeliveryAttemptsHeader = "x-delivery-attempts"
+
+	// DefaultPoisonLimit is how many deliveries a message gets before the
+	// subscriber stops requeueing it. Delayed retries count too.
+	DefaultPoisonLimit = 20
+)
+
+// attemptTracker remembers requeued messages between deliveries. Classic
+// queues only say whether a message was redelivered, not how often.
+type attemptTracker struct {
+	mu       sync.Mutex
+	attempts map[string]int
+	errors   map[string]string
+}
+
+func newAttemptTracker() *attemptTracker {
+	return &attemptTracker{attempts: map[string]int{}, errors: map[string]string{}}
+}
+
+func (t *attemptTracker) requeued(messageID string, err error) {
+	if messageID == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attempts[messageID]++
+	if err != nil {
+		t.errors[messageID] = err.Error()
+	}
+}
+
+func (t *attemptTracker) lookup(messageID string) (int, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.attempts[messageID], t.errors[messageID]
+}
+
+func (t *attemptTracker) forget(messageID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.attempts, messageID)
+	delete(t.errors, messageID)
+}
+
+// DeliveryAttempts estimates how many times msg has been handled, including
+// this delivery: every x-death entry (delayed retries, earlier rejections,
+// but not PublishDelayed's wait) plus requeues, taken from the quorum
+// x-delivery-count header, the local count or at least the Redelivered flag.
+func DeliveryAttempts(msg amqp.Delivery, localRequeues int) int {
+	attempts := 1
+	for _, death := range Deaths(msg.Headers) {
+		if !isDelayQueue(death.Queue) {
+			attempts += int(death.Count)
+		}
+	}
+
+	requeues := max(headerInt(msg.Headers, "x-delivery-count"), localRequeues)
+	if requeues == 0 && msg.Redelivered {
+		requeues = 1
+	}
+	return attempts + requeues
+}
+
+// lastError is the most specific error known for msg: this attempt's, a
+// requeued attempt's, or one carried over in its headers from a retry.
+func lastError(msg amqp.Delivery, current error, requeued string) string {
+	if current != nil {
+		return current.Error()
+	}
+	if requeued != "" {
+		return requeued
+	}
+	carried, _ := msg.Headers[LastErrorHeader].(string)
+	return carried
+}
+
+// deadLetter sends msg to the queue's dead letter exchange with the reason,
+// attempt count and last error in its headers and an x-death entry like the
+// broker's, then acks it. Without a known DLX, or if that publish fails, it
+// falls back to a plain reject and the broker dead-letters it.
+func (s *Subscription) deadLetter(msg amqp.Delivery, reason string, attempts int, lastErr string) {
+	s.tracker.forget(msg.MessageId)
+	deadLettersTotal.WithLabelValues(s.queue, reason).Inc()
+
+	if s.deadLetterExchange == "" {
+		s.ack(msg.Nack(false, false))
+		return
+	}
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	delete(headers, restoreErrorHeader)
+	headers[DeadLetterReasonHeader] = reason
+	headers[DeliveryAttemptsHeader] = int32(attempts)
+	if lastErr != "" {
+		headers[LastErrorHeader] = lastErr
+	}
+	headers["x-death"] = addDeath(headers["x-death"], amqp.Table{
+		"reason":       "rejected",
+		"queue":        s.queue,
+		"exchange":     msg.Exchange,
+		"routing-keys": []interface{}{msg.RoutingKey},
+		"time":         time.Now(),
+	})
+
+	key := s.deadLetterKey
+	if key == "" {
+		key = msg.RoutingKey
+	}
+
+	err := s.broker.Publish(context.Background(), s.deadLetterExchange, key, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	})
+	if err != nil {
+		log.Printf("Failed to dead-letter message %s from %s with details, rejecting it instead: %v", msg.MessageId, s.queue, err)
+		s.ack(msg.Nack(false, false))
+		return
+	}
+	s.ack(msg.Ack(false))
+}
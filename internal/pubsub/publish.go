@@ -1,104 +1,92 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func PublishJSON[T any](
-	ch *amqp.Channel,
+// Publish encodes val with codec, stamps the envelope (message ID, timestamp,
+// app ID, correlation ID and traceparent, continuing any envelope in ctx)
+// and waits for the broker to confirm it.
+func Publish[T any](
+	ctx context.Context,
+	broker Broker,
+	codec Codec,
 	exchange,
 	routingKey string,
 	val T,
 ) error {
-	// Marshal the value to JSON
-	data, err := json.Marshal(val)
+	msg, err := newPublishing(ctx, codec, val)
 	if err != nil {
 		return err
 	}
-	// Publish to the exchange with the routing key
-	return ch.PublishWithContext(
-		context.Background(),
-		exchange,
-		routingKey,
-		false, // mandatory
-		false, // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        data,
-		},
-	)
+
+	// Publish to the exchange with the routing key and wait for the broker to confirm
+	return broker.Publish(ctx, exchange, routingKey, msg)
 }
 
-func DeclareAndBind(
-	conn *amqp.Connection,
-	exchange,
-	queueName,
-	key string,
-	simpleQueueType SimpleQueueType, // This is the enum type that was made to rep "durable" or "transient"
-) (*amqp.Channel, amqp.Queue, error) {
-	// 1. Create the channel
-	ch, err := conn.Channel()
+// newPublishing encodes val and stamps its envelope and schema version.
+func newPublishing[T any](ctx context.Context, codec Codec, val T) (amqp.Publishing, error) {
+	data, err := codec.Marshal(val)
 	if err != nil {
-		return nil, amqp.Queue{}, err
+		return amqp.Publishing{}, err
+	}
+	msg := amqp.Publishing{
+		ContentType: codec.ContentType(),
+		Priority:    priorityOf(val),
+		Body:        data,
 	}
+	stamp(ctx, &msg)
+	stampSchema(val, &msg)
+	return msg, nil
+}
 
-	isDurable := simpleQueueType == SimpleQueueDurable      // durable
-	isAutoDelete := simpleQueueType == SimpleQueueTransient // auto-delete
-	isExclusive := simpleQueueType == SimpleQueueTransient
+// Prioritized values are published with their priority; queues declared
+// with a max priority (or quorum queues) deliver higher ones first.
+type Prioritized interface {
+	MessagePriority() uint8
+}
 
-	// creating table for args to be passed in
-	args := amqp.Table{
-		"x-dead-letter-exchange": "video_dlx",
+func priorityOf(val any) uint8 {
+	if p, ok := val.(Prioritized); ok {
+		return p.MessagePriority()
 	}
+	return 0
+}
 
-	queue, err := ch.QueueDeclare(
-		queueName,
-		isDurable,    // durable
-		isAutoDelete, // auto-delete
-		isExclusive,  // exclusive
-		false,        // noWait
-		args,         // args
-	)
-	if err != nil {
-		return nil, amqp.Queue{}, err
-	}
+func PublishJSON[T any](
+	broker Broker,
+	exchange,
+	routingKey string,
+	val T,
+) error {
+	return Publish(context.Background(), broker, JSON, exchange, routingKey, val)
+}
 
-	// 4. Bind queue
-	err = ch.QueueBind(queue.Name, key, exchange, false, nil)
+func DeclareAndBind(
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType, // This is the enum type that was made to rep "durable" or "transient"
+	args amqp.Table, // x-arguments such as the DLX, see QueueArgs
+) error {
+	// 1. Declare the queue
+	err := broker.QueueDeclare(queueName, simpleQueueType, args)
 	if err != nil {
-		return nil, amqp.Queue{}, err
+		return err
 	}
 
-	return ch, queue, nil
+	// 2. Bind queue
+	return broker.QueueBind(queueName, key, exchange)
 }
 
 func PublishGob[T any](
-	ch *amqp.Channel,
+	broker Broker,
 	exchange,
 	routingKey string,
 	val T,
 ) error {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(val)
-	if err != nil {
-		return err
-	}
-
-	return ch.PublishWithContext(
-		context.Background(),
-		exchange,
-		routingKey,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/gob",
-			Body:        buf.Bytes(),
-		},
-	)
+	return Publish(context.Background(), broker, Gob, exchange, routingKey, val)
 }
@@ -0,0 +1,146 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const DefaultConfirmTimeout = 5 * time.Second
+
+var (
+	ErrPublishNacked  = errors.New("pubsub: broker nacked the message")
+	ErrUnroutable     = errors.New("pubsub: message was not routed to any queue")
+	ErrConfirmTimeout = errors.New("pubsub: timed out waiting for broker confirm")
+	ErrChannelClosed  = errors.New("pubsub: channel closed before broker confirm")
+)
+
+// Publisher owns a channel in confirm mode. Every publish is mandatory and
+// blocks until the broker acks, nacks or returns it. The channel is reopened
+// on the next publish after a reconnect.
+type Publisher struct {
+	conn    *Connection
+	mu      sync.Mutex
+	ch      *amqp.Channel
+	returns chan amqp.Return
+	timeout time.Duration
+}
+
+func NewPublisher(conn *Connection, timeout time.Duration) (*Publisher, error) {
+	if timeout <= 0 {
+		timeout = DefaultConfirmTimeout
+	}
+
+	p := &Publisher{conn: conn, timeout: timeout}
+	if err := p.open(context.Background()); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Publisher) open(ctx context.Context) error {
+	ch, err := p.conn.Channel(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return err
+	}
+
+	p.ch = ch
+	p.returns = ch.NotifyReturn(make(chan amqp.Return, 8))
+	return nil
+}
+
+func (p *Publisher) Publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	start := time.Now()
+	err := p.publish(ctx, exchange, routingKey, msg)
+	observePublish(exchange, start, err)
+	return err
+}
+
+func (p *Publisher) publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	// One message in flight at a time so a basic.return always belongs to the current publish
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	if p.ch == nil || p.ch.IsClosed() {
+		if err := p.open(ctx); err != nil {
+			return err
+		}
+	}
+
+	p.drainReturns()
+
+	confirm, err := p.ch.PublishWithDeferredConfirmWithContext(
+		ctx,
+		exchange,
+		routingKey,
+		true,  // mandatory
+		false, // immediate
+		msg,
+	)
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fmt.Errorf("%w after %s", ErrConfirmTimeout, p.timeout)
+		}
+		return err
+	}
+
+	// The broker sends basic.return before the ack, so it is already buffered by now
+	select {
+	case ret, ok := <-p.returns:
+		if !ok {
+			return ErrChannelClosed
+		}
+		return fmt.Errorf("%w: %s/%s (%d %s)", ErrUnroutable, ret.Exchange, ret.RoutingKey, ret.ReplyCode, ret.ReplyText)
+	default:
+	}
+
+	if !acked {
+		if p.ch.IsClosed() {
+			return ErrChannelClosed
+		}
+		return ErrPublishNacked
+	}
+
+	return nil
+}
+
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ch == nil || p.ch.IsClosed() {
+		return nil
+	}
+	return p.ch.Close()
+}
+
+// drainReturns drops returns left over from a publish that timed out.
+func (p *Publisher) drainReturns() {
+	for {
+		select {
+		case _, ok := <-p.returns:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const RetryAttemptHeader = "x-retry-attempt"
+
+// RetryPolicy describes the delayed retry queues behind NackRetry. Attempt n
+// waits BaseDelay * 2^(n-1) in "<queue>.retry.<n>" before it is dead-lettered
+// back to the original exchange and routing key.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+}
+
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	return p.BaseDelay << (attempt - 1)
+}
+
+func RetryQueueName(queueName string, attempt int) string {
+	return fmt.Sprintf("%s.retry.%d", queueName, attempt)
+}
+
+// DeclareRetryQueues declares one TTL'd queue per attempt. They have no
+// consumers: messages sit there until they expire and go back to exchange
+// with key, so key must be a concrete routing key rather than a pattern.
+func DeclareRetryQueues(broker Broker, exchange, queueName, key string, policy RetryPolicy) error {
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		err := broker.QueueDeclare(
+			RetryQueueName(queueName, attempt),
+			SimpleQueueDurable,
+			amqp.Table{
+				"x-message-ttl":             policy.Delay(attempt).Milliseconds(),
+				"x-dead-letter-exchange":    exchange,
+				"x-dead-letter-routing-key": key,
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("declare retry queue %d for %s: %w", attempt, queueName, err)
+		}
+	}
+	return nil
+}
+
+// retry parks msg in the next retry queue and acks the original. Without a
+// policy, or once the budget is spent, the message is dead-lettered instead.
+// lastErr travels with the retry so it can still be reported if a later
+// attempt fails without saying why.
+func (s *Subscription) retry(msg amqp.Delivery, policy RetryPolicy, attempts int, lastErr string) {
+	attempt := headerInt(msg.Headers, RetryAttemptHeader) + 1
+	if attempt > policy.MaxAttempts {
+		log.Printf("Message on %s exhausted its retries after %d attempt(s), dead-lettering", s.queue, attempt-1)
+		s.deadLetter(msg, "retries-exhausted", attempts, lastErr)
+		return
+	}
+	s.tracker.forget(msg.MessageId)
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[RetryAttemptHeader] = int32(attempt)
+	if lastErr != "" {
+		headers[LastErrorHeader] = lastErr
+	}
+
+	err := s.broker.Publish(context.Background(), "", RetryQueueName(s.queue, attempt), amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	})
+	if err != nil {
+		// Could not park it, so let the broker hand it out again instead of losing it
+		log.Printf("Failed to schedule retry %d for message on %s: %v", attempt, s.queue, err)
+		s.ack(msg.Nack(false, true))
+		return
+	}
+
+	log.Printf("Retrying message on %s in %s (attempt %d/%d)", s.queue, policy.Delay(attempt), attempt, policy.MaxAttempts)
+	s.ack(msg.Ack(false))
+}
+
+func headerInt(headers amqp.Table, name string) int {
+	switch v := headers[name].(type) {
+	case int:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint8:
+		return int(v)
+	case uint16:
+		return int(v)
+	case uint32:
+		return int(v)
+	case float64:
+		// Headers that went through JSON, such as outbox rows
+		return int(v)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,244 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// DefaultCallTimeout applies when the context passed to Call has no deadline.
+	DefaultCallTimeout = 30 * time.Second
+
+	// RPCErrorHeader carries the error returned by a Serve handler.
+	RPCErrorHeader = "x-rpc-error"
+	// RPCDeadlineHeader is the caller's deadline in Unix milliseconds, so the
+	// server can skip requests nobody is waiting for any more.
+	RPCDeadlineHeader = "x-rpc-deadline"
+	// RPCCallIDHeader matches a reply to its call, leaving the correlation ID
+	// of both to the request that made the call.
+	RPCCallIDHeader = "x-rpc-call-id"
+)
+
+// RemoteError is returned by Call when the Serve handler returned an error.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "pubsub: remote error: " + e.Message
+}
+
+// replyQueue is the exclusive queue a process receives all of its replies on,
+// one per broker. Calls wait on a channel keyed by call ID.
+type replyQueue struct {
+	name string
+
+	mu      sync.Mutex
+	pending map[string]chan amqp.Delivery
+}
+
+var (
+	replyQueuesMu sync.Mutex
+	replyQueues   = map[Broker]*replyQueue{}
+)
+
+func replyQueueFor(broker Broker) (*replyQueue, error) {
+	replyQueuesMu.Lock()
+	defer replyQueuesMu.Unlock()
+
+	if rq, ok := replyQueues[broker]; ok {
+		return rq, nil
+	}
+
+	host, _ := os.Hostname()
+	rq := &replyQueue{
+		name:    fmt.Sprintf("rpc.reply.%s.%s.%d.%d", AppID, host, os.Getpid(), consumerSeq.Add(1)),
+		pending: map[string]chan amqp.Delivery{},
+	}
+
+	// Exclusive and auto-deleted like any SimpleQueueTransient queue. After a
+	// reconnect it is declared again under the same name, but replies sent
+	// while the connection was down are lost and those calls time out.
+	if err := broker.QueueDeclare(rq.name, SimpleQueueTransient, nil); err != nil {
+		return nil, err
+	}
+	msgs, err := broker.Consume(context.Background(), rq.name, rq.name, 0)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		rq.dispatch(msgs)
+
+		// The broker closed; the next Call sets up a fresh reply queue
+		replyQueuesMu.Lock()
+		delete(replyQueues, broker)
+		replyQueuesMu.Unlock()
+	}()
+
+	replyQueues[broker] = rq
+	return rq, nil
+}
+
+func (rq *replyQueue) dispatch(msgs <-chan amqp.Delivery) {
+	for msg := range msgs {
+		msg.Ack(false)
+
+		callID, _ := msg.Headers[RPCCallIDHeader].(string)
+		rq.mu.Lock()
+		waiting, ok := rq.pending[callID]
+		delete(rq.pending, callID)
+		rq.mu.Unlock()
+
+		if !ok {
+			// The caller already gave up
+			continue
+		}
+		waiting <- msg
+	}
+}
+
+func (rq *replyQueue) register(callID string) chan amqp.Delivery {
+	waiting := make(chan amqp.Delivery, 1)
+	rq.mu.Lock()
+	rq.pending[callID] = waiting
+	rq.mu.Unlock()
+	return waiting
+}
+
+func (rq *replyQueue) forget(callID string) {
+	rq.mu.Lock()
+	delete(rq.pending, callID)
+	rq.mu.Unlock()
+}
+
+// Call publishes req to exchange/routingKey and waits for the Serve handler's
+// reply. It gives up when ctx is cancelled or, if ctx has no deadline, after
+// DefaultCallTimeout. The request expires in the queue at the same moment,
+// so a late server never works on it. The request continues the correlation
+// and trace found in ctx.
+func Call[Req, Resp any](
+	ctx context.Context,
+	broker Broker,
+	codec Codec,
+	exchange,
+	routingKey string,
+	req Req,
+) (Resp, error) {
+	var resp Resp
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCallTimeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
+	rq, err := replyQueueFor(broker)
+	if err != nil {
+		return resp, fmt.Errorf("pubsub: reply queue: %w", err)
+	}
+
+	data, err := codec.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+
+	callID := NewMessageID()
+	msg := amqp.Publishing{
+		ContentType: codec.ContentType(),
+		ReplyTo:     rq.name,
+		Expiration:  strconv.FormatInt(max(time.Until(deadline).Milliseconds(), 1), 10),
+		Headers:     amqp.Table{RPCDeadlineHeader: deadline.UnixMilli(), RPCCallIDHeader: callID},
+		Body:        data,
+	}
+	stamp(ctx, &msg)
+	stampSchema(req, &msg)
+
+	waiting := rq.register(callID)
+	defer rq.forget(callID)
+
+	if err := broker.Publish(ctx, exchange, routingKey, msg); err != nil {
+		return resp, err
+	}
+
+	select {
+	case reply := <-waiting:
+		if remote, ok := reply.Headers[RPCErrorHeader].(string); ok {
+			return resp, &RemoteError{Message: remote}
+		}
+		return decodeBody[Resp](reply.ContentType, reply.Headers, reply.Body, codec)
+	case <-ctx.Done():
+		return resp, fmt.Errorf("pubsub: call %s/%s: %w", exchange, routingKey, ctx.Err())
+	}
+}
+
+// Serve answers Call requests arriving on queueName. The handler's context
+// carries the caller's deadline; its result, or its error as a RemoteError,
+// is sent back to the caller's reply queue. Requests are always acked once
+// answered, so a handler that should not run twice is never retried.
+func Serve[Req, Resp any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	codec Codec,
+	handler func(context.Context, Req, Envelope) (Resp, error),
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return SubscribeEnvelope(ctx, broker, exchange, queueName, key, simpleQueueType, codec, func(req Req, env Envelope) AckType {
+		if env.ReplyTo == "" {
+			log.Printf("RPC request %s on %s has no reply-to, discarding", env.MessageID, queueName)
+			return NackDiscard
+		}
+
+		callCtx := ContextWithEnvelope(ctx, env)
+		if ms := headerInt(env.Headers, RPCDeadlineHeader); ms > 0 {
+			deadline := time.UnixMilli(int64(ms))
+			if time.Now().After(deadline) {
+				log.Printf("RPC request %s on %s arrived after its deadline, dropping", env.MessageID, queueName)
+				return Ack
+			}
+			var cancel context.CancelFunc
+			callCtx, cancel = context.WithDeadline(callCtx, deadline)
+			defer cancel()
+		}
+
+		callID, _ := env.Headers[RPCCallIDHeader].(string)
+		reply := amqp.Publishing{
+			ContentType:   codec.ContentType(),
+			CorrelationId: env.CorrelationID,
+			Headers:       amqp.Table{RPCCallIDHeader: callID},
+		}
+
+		resp, err := handler(callCtx, req, env)
+		if err != nil {
+			reply.Headers[RPCErrorHeader] = err.Error()
+		} else if reply.Body, err = codec.Marshal(resp); err != nil {
+			reply.Headers[RPCErrorHeader] = fmt.Sprintf("encode response: %v", err)
+		} else {
+			stampSchema(resp, &reply)
+		}
+		stamp(callCtx, &reply)
+
+		// Use the subscription context: the caller's deadline may have just passed,
+		// and the reply is cheap to drop on their side
+		if err := broker.Publish(ctx, "", env.ReplyTo, reply); err != nil {
+			if errors.Is(err, ErrUnroutable) {
+				log.Printf("RPC caller for %s is gone, dropping reply", env.MessageID)
+			} else {
+				log.Printf("Failed to reply to RPC request %s: %v", env.MessageID, err)
+			}
+		}
+		return Ack
+	}, opts...)
+}
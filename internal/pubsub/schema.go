@@ -0,0 +1,68 @@
+package pubsub
+
+import (
+	"fmt"
+
+	"github.com/JerryG0311/Vidify/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// SchemaVersionHeader carries the version of a routing.Versioned message.
+const SchemaVersionHeader = "schema_version"
+
+// stampSchema records val's schema version on msg, if it has one.
+func stampSchema(val any, msg *amqp.Publishing) {
+	versioned, ok := val.(routing.Versioned)
+	if !ok {
+		return
+	}
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	msg.Headers[SchemaVersionHeader] = int32(versioned.SchemaVersion())
+}
+
+// decodeBody decodes a message body into T with the codec for contentType.
+// Versioned JSON payloads from older producers are upcast first; messages
+// with no version header count as version 1. Other codecs cannot decode into
+// the maps upcasters work on, so their older payloads decode as they are,
+// with zero values for the fields they lack. Newer versions decode as they
+// are, which routing's compatibility test keeps safe.
+func decodeBody[T any](contentType string, headers amqp.Table, body []byte, fallback Codec) (T, error) {
+	var target T
+	decoder, err := codecFor(contentType, fallback)
+	if err != nil {
+		return target, err
+	}
+
+	if versioned, ok := any(target).(routing.Versioned); ok && canUpcast(decoder) {
+		from := max(headerInt(headers, SchemaVersionHeader), 1)
+		if from < versioned.SchemaVersion() {
+			if body, err = upcast(decoder, versioned.SchemaName(), from, body); err != nil {
+				return target, err
+			}
+		}
+	}
+
+	err = decoder.Unmarshal(body, &target)
+	return target, err
+}
+
+// canUpcast reports whether codec decodes any body into a map keyed by the
+// JSON field names, as routing.Upcast expects. Gob and Protobuf need the
+// target type, and MsgPack keys maps by Go field names.
+func canUpcast(codec Codec) bool {
+	_, ok := codec.(jsonCodec)
+	return ok
+}
+
+func upcast(codec Codec, name string, from int, body []byte) ([]byte, error) {
+	var doc map[string]any
+	if err := codec.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("decode %s v%d for upcasting: %w", name, from, err)
+	}
+	if err := routing.Upcast(name, from, doc); err != nil {
+		return nil, err
+	}
+	return codec.Marshal(doc)
+}
@@ -0,0 +1,167 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// StreamOffsetHeader carries a delivery's position in a stream, and is also
+// the consume argument saying where to start reading.
+const StreamOffsetHeader = "x-stream-offset"
+
+// Streams need a prefetch; this is used when none is set with WithPrefetch.
+const defaultStreamPrefetch = 100
+
+// StreamOffset says where a stream subscription starts reading.
+type StreamOffset struct {
+	value any
+}
+
+var (
+	// StreamFirst replays everything the stream still retains.
+	StreamFirst = StreamOffset{"first"}
+	// StreamLast starts at the last chunk written to the stream.
+	StreamLast = StreamOffset{"last"}
+	// StreamNext only reads messages published from now on.
+	StreamNext = StreamOffset{"next"}
+)
+
+// StreamAt starts at a specific offset, e.g. one past the last offset a
+// consumer stored before it stopped.
+func StreamAt(offset int64) StreamOffset {
+	return StreamOffset{offset}
+}
+
+// StreamSince starts at the first chunk written at or after t.
+func StreamSince(t time.Time) StreamOffset {
+	return StreamOffset{t}
+}
+
+func (o StreamOffset) arg() any {
+	if o.value == nil {
+		return "next"
+	}
+	return o.value
+}
+
+// StreamBroker is implemented by brokers that can read a stream from an
+// offset: *Connection and MemoryBroker.
+type StreamBroker interface {
+	ConsumeStream(ctx context.Context, streamName, consumerTag string, prefetch int, offset StreamOffset) (<-chan amqp.Delivery, error)
+}
+
+// ConsumeStream reads streamName starting at offset. After a reconnect it
+// resumes right after the last delivery it handed out rather than at offset.
+func (c *Connection) ConsumeStream(ctx context.Context, streamName, consumerTag string, prefetch int, offset StreamOffset) (<-chan amqp.Delivery, error) {
+	if prefetch < 1 {
+		prefetch = defaultStreamPrefetch
+	}
+
+	var mu sync.Mutex
+	last := int64(-1)
+
+	return c.consume(ctx, &amqpConsumer{
+		conn:     c,
+		queue:    streamName,
+		tag:      consumerTag,
+		prefetch: prefetch,
+		args: func() amqp.Table {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if last >= 0 {
+				return amqp.Table{StreamOffsetHeader: last + 1}
+			}
+			return amqp.Table{StreamOffsetHeader: offset.arg()}
+		},
+		seen: func(msg amqp.Delivery) {
+			if position, ok := msg.Headers[StreamOffsetHeader].(int64); ok {
+				mu.Lock()
+				last = position
+				mu.Unlock()
+			}
+		},
+	})
+}
+
+// StreamHandler handles one stream message. offset is its position in the
+// stream; store it to resume with StreamAt(offset+1) later.
+type StreamHandler[T any] func(val T, offset int64, env Envelope) error
+
+// SubscribeStream declares streamName as a stream bound to exchange with key
+// and reads it from offset, in order, on a single goroutine. Streams keep
+// their messages, so nothing is requeued or dead-lettered: every delivery is
+// acked, and handler or decode errors are reported on Errors.
+func SubscribeStream[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	streamName,
+	key string,
+	codec Codec,
+	offset StreamOffset,
+	handler StreamHandler[T],
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	streams, ok := broker.(StreamBroker)
+	if !ok {
+		return nil, fmt.Errorf("pubsub: %T does not support streams", broker)
+	}
+	options := newSubscribeOptions(append([]SubscribeOption{WithPrefetch(defaultStreamPrefetch)}, opts...))
+
+	var args amqp.Table
+	if queue, ok := options.topology.Queue(streamName); ok {
+		args = QueueArgs(queue)
+	}
+	if err := DeclareAndBind(broker, exchange, streamName, key, SimpleQueueStream, args); err != nil {
+		return nil, err
+	}
+
+	sub := newSubscription(ctx, broker, streamName)
+
+	msgs, err := streams.ConsumeStream(sub.ctx, streamName, sub.tag, options.prefetch, offset)
+	if err != nil {
+		sub.stop()
+		return nil, err
+	}
+
+	go func() {
+		defer sub.finish()
+
+		for msg := range msgs {
+			position, _ := msg.Headers[StreamOffsetHeader].(int64)
+
+			var val T
+			var err error
+			if restoreErr, ok := msg.Headers[restoreErrorHeader].(string); ok {
+				err = errors.New(restoreErr)
+			} else {
+				val, err = decodeBody[T](msg.ContentType, msg.Headers, msg.Body, codec)
+			}
+			deliveriesTotal.WithLabelValues(streamName).Inc()
+			if err != nil {
+				decodeFailuresTotal.WithLabelValues(streamName).Inc()
+				sub.report(fmt.Errorf("decode %s offset %d: %w", streamName, position, err))
+			} else {
+				start := time.Now()
+				err := handler(val, position, envelopeFromDelivery(msg))
+				outcome := "ack"
+				if err != nil {
+					outcome = "error"
+					sub.report(fmt.Errorf("handle %s offset %d: %w", streamName, position, err))
+				}
+				observeHandled(streamName, msg, start, outcome)
+			}
+
+			// Acks only tell the broker to send more
+			sub.ack(msg.Ack(false))
+		}
+	}()
+
+	return sub, nil
+}
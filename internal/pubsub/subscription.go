@@ -0,0 +1,90 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+var consumerSeq atomic.Uint64
+
+// Subscription is the handle returned by Subscribe. Cancelling the context
+// passed to Subscribe (or calling Shutdown) cancels the consumer so no new
+// deliveries arrive; in-flight handlers are left to finish.
+type Subscription struct {
+	queue  string
+	tag    string
+	broker Broker
+
+	// Where deadLetter sends messages it gives up on; empty falls back to
+	// rejecting them and letting the queue's own DLX take over.
+	deadLetterExchange string
+	deadLetterKey      string
+	tracker            *attemptTracker
+
+	ctx  context.Context
+	stop context.CancelFunc
+
+	done chan struct{}
+	errs chan error
+}
+
+func newSubscription(parent context.Context, broker Broker, queueName string) *Subscription {
+	ctx, stop := context.WithCancel(parent)
+	host, _ := os.Hostname()
+
+	return &Subscription{
+		queue:   queueName,
+		tag:     fmt.Sprintf("%s-%s-%d-%d", queueName, host, os.Getpid(), consumerSeq.Add(1)),
+		broker:  broker,
+		tracker: newAttemptTracker(),
+		ctx:     ctx,
+		stop:    stop,
+		done:    make(chan struct{}),
+		errs:    make(chan error, 16),
+	}
+}
+
+// Shutdown stops consuming and waits until every in-flight handler has
+// returned and been acked, or until ctx expires. Unacked messages are
+// redelivered by the broker once the process exits.
+func (s *Subscription) Shutdown(ctx context.Context) error {
+	s.stop()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("pubsub: waiting for %s handlers to drain: %w", s.queue, ctx.Err())
+	}
+}
+
+// Done is closed once the subscription has stopped and its handlers have returned.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Errors reports ack and retry failures. It is buffered and errors are
+// dropped when nobody is reading.
+func (s *Subscription) Errors() <-chan error {
+	return s.errs
+}
+
+func (s *Subscription) finish() {
+	s.stop()
+	close(s.done)
+}
+
+func (s *Subscription) ack(err error) {
+	if err != nil {
+		s.report(fmt.Errorf("ack on %s: %w", s.queue, err))
+	}
+}
+
+func (s *Subscription) report(err error) {
+	select {
+	case s.errs <- err:
+	default:
+	}
+}
@@ -0,0 +1,101 @@
+package pubsub
+
+import (
+	"fmt"
+
+	"github.com/JerryG0311/Vidify/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ApplyTopology declares every exchange, queue and binding in topology.
+// Declarations are idempotent, so every binary can apply the same topology at
+// startup; a queue that already exists with different arguments is an error.
+func ApplyTopology(broker Broker, topology routing.Topology) error {
+	for _, exchange := range topology.Exchanges {
+		if err := broker.ExchangeDeclare(exchange.Name, exchange.Kind); err != nil {
+			return fmt.Errorf("declare exchange %s: %w", exchange.Name, err)
+		}
+	}
+
+	for _, queue := range topology.Queues {
+		if err := validateQueue(queue); err != nil {
+			return err
+		}
+		if err := broker.QueueDeclare(queue.Name, queueSimpleType(queue), QueueArgs(queue)); err != nil {
+			return fmt.Errorf("declare queue %s: %w", queue.Name, err)
+		}
+	}
+
+	for _, binding := range topology.Bindings {
+		if err := broker.QueueBind(binding.Queue, binding.Key, binding.Exchange); err != nil {
+			return fmt.Errorf("bind queue %s to %s with %q: %w", binding.Queue, binding.Exchange, binding.Key, err)
+		}
+	}
+	return nil
+}
+
+// QueueArgs turns a queue description into its x-arguments.
+func QueueArgs(queue routing.Queue) amqp.Table {
+	args := amqp.Table{}
+	if queue.Type != "" && queue.Type != routing.QueueTypeClassic {
+		args["x-queue-type"] = queue.Type
+	}
+	if queue.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = queue.DeadLetterExchange
+	}
+	if queue.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = queue.DeadLetterRoutingKey
+	}
+	if queue.MessageTTL > 0 {
+		args["x-message-ttl"] = queue.MessageTTL.Milliseconds()
+	}
+	if queue.DeliveryLimit > 0 {
+		args["x-delivery-limit"] = int64(queue.DeliveryLimit)
+	}
+	if queue.MaxPriority > 0 {
+		args["x-max-priority"] = int64(queue.MaxPriority)
+	}
+	if queue.MaxAge > 0 {
+		args["x-max-age"] = fmt.Sprintf("%ds", int64(queue.MaxAge.Seconds()))
+	}
+	return args
+}
+
+func queueSimpleType(queue routing.Queue) SimpleQueueType {
+	switch {
+	case queue.Type == routing.QueueTypeQuorum:
+		return SimpleQueueQuorum
+	case queue.Type == routing.QueueTypeStream:
+		return SimpleQueueStream
+	case queue.Durable:
+		return SimpleQueueDurable
+	default:
+		return SimpleQueueTransient
+	}
+}
+
+func validateQueue(queue routing.Queue) error {
+	switch queue.Type {
+	case "", routing.QueueTypeClassic, routing.QueueTypeQuorum, routing.QueueTypeStream:
+	default:
+		return fmt.Errorf("pubsub: queue %s has unknown type %q", queue.Name, queue.Type)
+	}
+
+	replicated := queue.Type == routing.QueueTypeQuorum || queue.Type == routing.QueueTypeStream
+	if replicated && !queue.Durable {
+		return fmt.Errorf("pubsub: %s queue %s must be durable", queue.Type, queue.Name)
+	}
+	if queue.DeliveryLimit > 0 && queue.Type != routing.QueueTypeQuorum {
+		return fmt.Errorf("pubsub: queue %s sets a delivery limit but is not a quorum queue", queue.Name)
+	}
+	if queue.Type == routing.QueueTypeStream && (queue.DeadLetterExchange != "" || queue.MessageTTL > 0) {
+		return fmt.Errorf("pubsub: stream %s cannot dead-letter or expire messages, use MaxAge", queue.Name)
+	}
+	if queue.MaxPriority > 0 && replicated {
+		return fmt.Errorf("pubsub: %s queue %s cannot set a max priority", queue.Type, queue.Name)
+	}
+	if queue.MaxAge > 0 && queue.Type != routing.QueueTypeStream {
+		return fmt.Errorf("pubsub: queue %s sets a max age but is not a stream", queue.Name)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package routing
+
+import "time"
+
+// Kinds of VideoEvent. Each is published on ExchangeVideoTopic with the
+// routing key "video.<kind>".
+const (
+	EventProcessing = "processing"
+	EventProgress   = "progress"
+	EventCompleted  = "completed"
+	EventFailed     = "failed"
+
+	VideoProcessingKey = "video." + EventProcessing
+	VideoProgressKey   = "video." + EventProgress
+	VideoCompletedKey  = "video." + EventCompleted
+	VideoFailedKey     = "video." + EventFailed
+
+	// VideoStatusQueue is where the API picks up events to update videos.
+	VideoStatusQueue = "video_status"
+)
+
+// VideoEventKeys lists the routing keys of every lifecycle event.
+var VideoEventKeys = []string{VideoProcessingKey, VideoProgressKey, VideoCompletedKey, VideoFailedKey}
+
+// VideoEvent reports what a worker did with a job. The worker never touches
+// the database; the API applies these events to the videos table.
+type VideoEvent struct {
+	VideoID  string    `json:"video_id"`
+	Kind     string    `json:"kind"`
+	At       time.Time `json:"at"`
+	WorkerID string    `json:"worker_id,omitempty"`
+
+	// progress: the stage just finished and roughly how far along the job is
+	Stage   string `json:"stage,omitempty"`
+	Percent int    `json:"percent,omitempty"`
+
+	// completed
+	ProcessedURL      string  `json:"processed_url,omitempty"`
+	ThumbnailURL      string  `json:"thumbnail_url,omitempty"`
+	DurationSeconds   float64 `json:"duration_seconds,omitempty"`
+	ProcessingSeconds float64 `json:"processing_seconds,omitempty"`
+
+	// failed: Retrying is set when the job will be tried again
+	Error    string `json:"error,omitempty"`
+	Retrying bool   `json:"retrying,omitempty"`
+}
+
+// RoutingKey is the key the event is published with.
+func (e VideoEvent) RoutingKey() string {
+	return "video." + e.Kind
+}
+
+// VideoCancelKey carries VideoCancel requests on ExchangeVideoTopic.
+const VideoCancelKey = "video.cancel"
+
+// VideoCancel tells every worker to stop work on a video, such as one the
+// user deleted: a running job has its ffmpeg killed and nothing uploaded,
+// and a job still queued is skipped when it is delivered.
+type VideoCancel struct {
+	VideoID     string    `json:"video_id"`
+	UserID      string    `json:"user_id"`
+	RequestedAt time.Time `json:"requested_at"`
+	Reason      string    `json:"reason,omitempty"`
+}
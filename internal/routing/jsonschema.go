@@ -0,0 +1,114 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+//go:generate go test -run TestSchemaSnapshots -update .
+
+// JSONSchemaDraft is the JSON Schema dialect JSONSchema produces.
+const JSONSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// JSONSchema describes the schema's type as a JSON Schema document, derived
+// from its json struct tags. Fields without omitempty are required. Unknown
+// fields are allowed, since newer producers may add them.
+func (s Schema) JSONSchema() ([]byte, error) {
+	doc, err := typeSchema(s.Type)
+	if err != nil {
+		return nil, fmt.Errorf("routing: schema for %s: %w", s.Name, err)
+	}
+	doc["$schema"] = JSONSchemaDraft
+	doc["$id"] = fmt.Sprintf("%s.v%d", s.Name, s.Version)
+	doc["title"] = s.Type.Name()
+
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func typeSchema(t reflect.Type) (map[string]any, error) {
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}, nil
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}, nil
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}, nil
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// encoding/json sends []byte as base64
+			return map[string]any{"type": "string", "contentEncoding": "base64"}, nil
+		}
+		items, err := typeSchema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"type": "array", "items": items}, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("map key %s is not a string", t.Key())
+		}
+		values, err := typeSchema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"type": "object", "additionalProperties": values}, nil
+	case reflect.Struct:
+		return structSchema(t)
+	default:
+		return nil, fmt.Errorf("%s has no JSON Schema mapping", t)
+	}
+}
+
+func structSchema(t reflect.Type) (map[string]any, error) {
+	properties := map[string]any{}
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		prop, err := typeSchema(field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		properties[name] = prop
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	return map[string]any{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}, nil
+}
@@ -0,0 +1,175 @@
+package routing
+
+import (
+	"fmt"
+	"time"
+)
+
+// Kinds of pipeline step. Workers take each kind from its own queue, so a
+// long transcode never holds up a thumbnail and every kind retries on its own.
+const (
+	StepProbe     = "probe"
+	StepThumbnail = "thumbnail"
+	StepTranscode = "transcode"
+	StepPackage   = "package"
+	StepPublish   = "publish"
+)
+
+// StepKinds lists every kind of step a worker runs.
+var StepKinds = []string{StepProbe, StepThumbnail, StepTranscode, StepPackage, StepPublish}
+
+const (
+	// StepResultKey carries StepResult messages from the workers to the API.
+	StepResultKey   = "video.step_result"
+	StepResultQueue = "video_step_results"
+)
+
+// StepKey is the routing key tasks of kind are published with.
+func StepKey(kind string) string {
+	return "video.step." + kind
+}
+
+// StepQueue is the queue workers take tasks of kind from.
+func StepQueue(kind string) string {
+	return "video_step_" + kind
+}
+
+// Target formats a VideoJob can ask for. Each is processed by the pipeline
+// of the same name.
+const (
+	FormatMP4 = "mp4"
+	FormatHLS = "hls"
+)
+
+// PipelineStep is one node of a pipeline. It is queued once every step in
+// Needs is done, with their outputs as its inputs.
+type PipelineStep struct {
+	Name   string
+	Kind   string
+	Needs  []string
+	Params map[string]string
+}
+
+// Pipeline is the set of steps that turns an upload into a playable video.
+// Steps are listed so that each comes after the steps it needs.
+type Pipeline struct {
+	Name  string
+	Steps []PipelineStep
+}
+
+// Step looks up a step by name.
+func (p Pipeline) Step(name string) (PipelineStep, bool) {
+	for _, step := range p.Steps {
+		if step.Name == name {
+			return step, true
+		}
+	}
+	return PipelineStep{}, false
+}
+
+// Validate checks that step names are unique, every kind is known and every
+// step only needs steps listed before it, which also rules out cycles.
+func (p Pipeline) Validate() error {
+	seen := map[string]bool{}
+	for _, step := range p.Steps {
+		if step.Name == "" || seen[step.Name] {
+			return fmt.Errorf("routing: pipeline %s: step name %q is empty or repeated", p.Name, step.Name)
+		}
+		known := false
+		for _, kind := range StepKinds {
+			known = known || kind == step.Kind
+		}
+		if !known {
+			return fmt.Errorf("routing: pipeline %s: step %s has unknown kind %q", p.Name, step.Name, step.Kind)
+		}
+		for _, need := range step.Needs {
+			if !seen[need] {
+				return fmt.Errorf("routing: pipeline %s: step %s needs %q, which is not listed before it", p.Name, step.Name, need)
+			}
+		}
+		seen[step.Name] = true
+	}
+	if len(p.Steps) == 0 {
+		return fmt.Errorf("routing: pipeline %s has no steps", p.Name)
+	}
+	return nil
+}
+
+// Pipelines holds the pipeline for every target format. The probe runs
+// first so an unreadable upload fails before anything is transcoded.
+var Pipelines = map[string]Pipeline{
+	FormatMP4: {
+		Name: FormatMP4,
+		Steps: []PipelineStep{
+			{Name: "probe", Kind: StepProbe},
+			{Name: "thumbnail", Kind: StepThumbnail, Needs: []string{"probe"}},
+			{Name: "transcode", Kind: StepTranscode, Needs: []string{"probe"}, Params: map[string]string{"rendition": "processed"}},
+			{Name: "publish", Kind: StepPublish, Needs: []string{"probe", "thumbnail", "transcode"}, Params: map[string]string{"video": "transcode"}},
+		},
+	},
+	// HLS renditions are packaged into one playlist; the 720p file is what
+	// the player and downloads serve.
+	FormatHLS: {
+		Name: FormatHLS,
+		Steps: []PipelineStep{
+			{Name: "probe", Kind: StepProbe},
+			{Name: "thumbnail", Kind: StepThumbnail, Needs: []string{"probe"}},
+			{Name: "transcode_1080p", Kind: StepTranscode, Needs: []string{"probe"}, Params: map[string]string{"rendition": "1080p", "height": "1080"}},
+			{Name: "transcode_720p", Kind: StepTranscode, Needs: []string{"probe"}, Params: map[string]string{"rendition": "720p", "height": "720"}},
+			{Name: "transcode_480p", Kind: StepTranscode, Needs: []string{"probe"}, Params: map[string]string{"rendition": "480p", "height": "480"}},
+			{Name: "package", Kind: StepPackage, Needs: []string{"transcode_1080p", "transcode_720p", "transcode_480p"}},
+			{Name: "publish", Kind: StepPublish, Needs: []string{"probe", "thumbnail", "transcode_720p", "package"}, Params: map[string]string{"video": "transcode_720p"}},
+		},
+	},
+}
+
+// PipelineFor picks the pipeline for a job's target format. Jobs without
+// one get the MP4 pipeline.
+func PipelineFor(targetFormat string) (Pipeline, error) {
+	if targetFormat == "" {
+		targetFormat = FormatMP4
+	}
+	pipeline, ok := Pipelines[targetFormat]
+	if !ok {
+		return Pipeline{}, fmt.Errorf("routing: no pipeline for target format %q", targetFormat)
+	}
+	return pipeline, nil
+}
+
+// StepTask asks a worker to run one step of a pipeline run. Inputs holds the
+// outputs of the steps it needs, keyed "<step>.<output>".
+type StepTask struct {
+	RunID      string            `json:"run_id"`
+	VideoID    string            `json:"video_id"`
+	SourcePath string            `json:"source_path"`
+	Step       string            `json:"step"`
+	Kind       string            `json:"kind"`
+	Needs      []string          `json:"needs,omitempty"`
+	Params     map[string]string `json:"params,omitempty"`
+	Inputs     map[string]string `json:"inputs,omitempty"`
+	// How far along the run is once this step is done
+	Percent   int       `json:"percent"`
+	StartedAt time.Time `json:"started_at"`
+	Priority  uint8     `json:"priority"`
+}
+
+// MessagePriority keeps a run's steps in the lane of the job that started it.
+func (t StepTask) MessagePriority() uint8 {
+	return t.Priority
+}
+
+// Input returns the output key of the step it needs named step.
+func (t StepTask) Input(step, key string) string {
+	return t.Inputs[step+"."+key]
+}
+
+// StepResult reports how a step went. Outputs are passed on to the steps
+// that need it; Retrying is set when a failed step will be tried again.
+type StepResult struct {
+	RunID    string            `json:"run_id"`
+	Step     string            `json:"step"`
+	WorkerID string            `json:"worker_id,omitempty"`
+	Outputs  map[string]string `json:"outputs,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Retrying bool              `json:"retrying,omitempty"`
+}
@@ -0,0 +1,31 @@
+package routing
+
+import "testing"
+
+func TestPipelinesAreValid(t *testing.T) {
+	for format, pipeline := range Pipelines {
+		if pipeline.Name != format {
+			t.Errorf("pipeline %s is registered for format %s", pipeline.Name, format)
+		}
+		if err := pipeline.Validate(); err != nil {
+			t.Error(err)
+		}
+		for _, step := range pipeline.Steps {
+			if video := step.Params["video"]; video != "" {
+				if _, ok := pipeline.Step(video); !ok {
+					t.Errorf("pipeline %s: step %s publishes the output of unknown step %q", format, step.Name, video)
+				}
+			}
+		}
+	}
+}
+
+func TestPipelineRejectsCycles(t *testing.T) {
+	pipeline := Pipeline{Name: "loop", Steps: []PipelineStep{
+		{Name: "a", Kind: StepProbe, Needs: []string{"b"}},
+		{Name: "b", Kind: StepProbe, Needs: []string{"a"}},
+	}}
+	if err := pipeline.Validate(); err == nil {
+		t.Fatal("expected a pipeline whose steps need each other to be rejected")
+	}
+}
@@ -0,0 +1,138 @@
+package routing
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Message schema versions. Bump one whenever the JSON shape of its type
+// changes, snapshot the new schema (go generate ./internal/routing) and, if
+// older messages need filling in, register an upcaster below.
+const (
+	VideoJobVersion     = 2 // v2 added priority
+	ProbeRequestVersion = 1
+	ProbeResultVersion  = 1
+	VideoEventVersion   = 1
+	VideoCancelVersion  = 1
+	StepTaskVersion     = 1
+	StepResultVersion   = 1
+)
+
+// Versioned messages are published with their version in the schema_version
+// header so consumers can upcast payloads from older producers.
+type Versioned interface {
+	SchemaName() string
+	SchemaVersion() int
+}
+
+func (VideoJob) SchemaName() string     { return "video.job" }
+func (VideoJob) SchemaVersion() int     { return VideoJobVersion }
+func (ProbeRequest) SchemaName() string { return "video.probe.request" }
+func (ProbeRequest) SchemaVersion() int { return ProbeRequestVersion }
+func (ProbeResult) SchemaName() string  { return "video.probe.result" }
+func (ProbeResult) SchemaVersion() int  { return ProbeResultVersion }
+func (VideoEvent) SchemaName() string   { return "video.event" }
+func (VideoEvent) SchemaVersion() int   { return VideoEventVersion }
+func (VideoCancel) SchemaName() string  { return "video.cancel" }
+func (VideoCancel) SchemaVersion() int  { return VideoCancelVersion }
+func (StepTask) SchemaName() string     { return "video.step.task" }
+func (StepTask) SchemaVersion() int     { return StepTaskVersion }
+func (StepResult) SchemaName() string   { return "video.step.result" }
+func (StepResult) SchemaVersion() int   { return StepResultVersion }
+
+// Upcaster rewrites a decoded payload of one version into the next one,
+// in place. Payloads are generic maps keyed by the JSON field names.
+type Upcaster func(doc map[string]any) error
+
+// Schema is one message contract. Upcasters is keyed by the version each
+// one upgrades from, so there is one per version below Version.
+type Schema struct {
+	Name      string
+	Version   int
+	Type      reflect.Type
+	Upcasters map[int]Upcaster
+}
+
+// Schemas lists every message type exchanged through RabbitMQ.
+var Schemas = []Schema{
+	{
+		Name:    VideoJob{}.SchemaName(),
+		Version: VideoJobVersion,
+		Type:    reflect.TypeOf(VideoJob{}),
+		Upcasters: map[int]Upcaster{
+			1: upcastVideoJobV1,
+		},
+	},
+	{
+		Name:    ProbeRequest{}.SchemaName(),
+		Version: ProbeRequestVersion,
+		Type:    reflect.TypeOf(ProbeRequest{}),
+	},
+	{
+		Name:    ProbeResult{}.SchemaName(),
+		Version: ProbeResultVersion,
+		Type:    reflect.TypeOf(ProbeResult{}),
+	},
+	{
+		Name:    VideoEvent{}.SchemaName(),
+		Version: VideoEventVersion,
+		Type:    reflect.TypeOf(VideoEvent{}),
+	},
+	{
+		Name:    VideoCancel{}.SchemaName(),
+		Version: VideoCancelVersion,
+		Type:    reflect.TypeOf(VideoCancel{}),
+	},
+	{
+		Name:    StepTask{}.SchemaName(),
+		Version: StepTaskVersion,
+		Type:    reflect.TypeOf(StepTask{}),
+	},
+	{
+		Name:    StepResult{}.SchemaName(),
+		Version: StepResultVersion,
+		Type:    reflect.TypeOf(StepResult{}),
+	},
+}
+
+// LookupSchema finds a registered schema by name.
+func LookupSchema(name string) (Schema, bool) {
+	for _, schema := range Schemas {
+		if schema.Name == name {
+			return schema, true
+		}
+	}
+	return Schema{}, false
+}
+
+// Upcast brings doc from version from up to the current version of the
+// named schema. Messages published before versioning carry no header and
+// count as version 1.
+func Upcast(name string, from int, doc map[string]any) error {
+	schema, ok := LookupSchema(name)
+	if !ok {
+		return fmt.Errorf("routing: unknown schema %q", name)
+	}
+	if from < 1 {
+		from = 1
+	}
+	for version := from; version < schema.Version; version++ {
+		upcast, ok := schema.Upcasters[version]
+		if !ok {
+			return fmt.Errorf("routing: no upcaster for %s from version %d", name, version)
+		}
+		if err := upcast(doc); err != nil {
+			return fmt.Errorf("routing: upcast %s from version %d: %w", name, version, err)
+		}
+	}
+	return nil
+}
+
+// upcastVideoJobV1 gives jobs from builds before priorities the normal lane
+// instead of 0, which would put them behind every current upload.
+func upcastVideoJobV1(doc map[string]any) error {
+	if _, ok := doc["priority"]; !ok {
+		doc["priority"] = PriorityNormal
+	}
+	return nil
+}
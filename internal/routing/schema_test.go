@@ -0,0 +1,139 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "write snapshots for schema versions that have none yet")
+
+const snapshotDir = "schemas"
+
+func snapshotPath(name string, version int) string {
+	return filepath.Join(snapshotDir, fmt.Sprintf("%s.v%d.json", name, version))
+}
+
+type jsonSchema struct {
+	Properties map[string]map[string]any `json:"properties"`
+	Required   []string                  `json:"required"`
+}
+
+func loadSnapshot(t *testing.T, name string, version int) jsonSchema {
+	t.Helper()
+
+	data, err := os.ReadFile(snapshotPath(name, version))
+	if err != nil {
+		t.Fatalf("%s v%d has no snapshot, so compatibility with it cannot be checked: %v", name, version, err)
+	}
+	var schema jsonSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatalf("parse %s: %v", snapshotPath(name, version), err)
+	}
+	return schema
+}
+
+// TestSchemaSnapshots fails when a type's JSON shape changed but its version
+// did not. Snapshots of released versions are never overwritten: bump the
+// version and run go generate ./internal/routing to add one.
+func TestSchemaSnapshots(t *testing.T) {
+	for _, schema := range Schemas {
+		generated, err := schema.JSONSchema()
+		if err != nil {
+			t.Fatalf("generate %s: %v", schema.Name, err)
+		}
+
+		path := snapshotPath(schema.Name, schema.Version)
+		snapshot, err := os.ReadFile(path)
+		if os.IsNotExist(err) && *update {
+			if err := os.WriteFile(path, generated, 0o644); err != nil {
+				t.Fatalf("write %s: %v", path, err)
+			}
+			t.Logf("wrote %s", path)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s v%d has no snapshot (run go generate ./internal/routing): %v", schema.Name, schema.Version, err)
+		}
+
+		if !bytes.Equal(snapshot, generated) {
+			t.Errorf("%s changed since %s was written; bump its version instead of editing a released one.\nsnapshot:\n%s\ngenerated:\n%s",
+				schema.Name, path, snapshot, generated)
+		}
+	}
+}
+
+// TestSchemasStayCompatible checks every released version against the
+// current one: older consumers must still find the fields they require with
+// the same types, and fields that became required need an upcaster for
+// messages from older producers.
+func TestSchemasStayCompatible(t *testing.T) {
+	for _, schema := range Schemas {
+		current := loadSnapshot(t, schema.Name, schema.Version)
+
+		for version := 1; version < schema.Version; version++ {
+			old := loadSnapshot(t, schema.Name, version)
+
+			for _, field := range old.Required {
+				prop, ok := current.Properties[field]
+				if !ok {
+					t.Errorf("%s v%d removes %q, which v%d consumers require", schema.Name, schema.Version, field, version)
+					continue
+				}
+				if !reflect.DeepEqual(prop, old.Properties[field]) {
+					t.Errorf("%s v%d changes %q from %v to %v, breaking v%d consumers", schema.Name, schema.Version, field, old.Properties[field], prop, version)
+				}
+			}
+
+			for _, field := range current.Required {
+				if _, ok := old.Properties[field]; ok {
+					continue
+				}
+				if _, ok := schema.Upcasters[version]; !ok {
+					t.Errorf("%s v%d requires %q, which v%d messages lack, but has no upcaster from v%d", schema.Name, schema.Version, field, version, version)
+				}
+			}
+		}
+	}
+}
+
+func TestSchemasMatchTheirTypes(t *testing.T) {
+	seen := map[string]bool{}
+	for _, schema := range Schemas {
+		if seen[schema.Name] {
+			t.Errorf("schema %s registered twice", schema.Name)
+		}
+		seen[schema.Name] = true
+
+		versioned, ok := reflect.Zero(schema.Type).Interface().(Versioned)
+		if !ok {
+			t.Errorf("%s does not implement Versioned", schema.Type)
+			continue
+		}
+		if versioned.SchemaName() != schema.Name || versioned.SchemaVersion() != schema.Version {
+			t.Errorf("%s reports %s v%d but is registered as %s v%d",
+				schema.Type, versioned.SchemaName(), versioned.SchemaVersion(), schema.Name, schema.Version)
+		}
+	}
+}
+
+func TestUpcastVideoJobFromV1(t *testing.T) {
+	doc := map[string]any{"id": "vid-1", "source_path": "s3://bucket/vid-1.mp4"}
+	if err := Upcast(VideoJob{}.SchemaName(), 1, doc); err != nil {
+		t.Fatalf("upcast: %v", err)
+	}
+
+	data, _ := json.Marshal(doc)
+	var job VideoJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		t.Fatalf("decode upcast job: %v", err)
+	}
+	if job.ID != "vid-1" || job.Priority != PriorityNormal {
+		t.Fatalf("expected vid-1 with normal priority, got %+v", job)
+	}
+}
@@ -0,0 +1,173 @@
+package routing
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	VideoDeliveryLimit = 10
+	// Subscribers of the queues with VideoDeliveryLimit dead-letter a message
+	// as poison first, with its last error, rather than let the broker do it
+	VideoPoisonLimit = VideoDeliveryLimit - 1
+	// How far back analytics can replay the video events stream
+	VideoEventsMaxAge = 30 * 24 * time.Hour
+	// How long a cancellation is remembered; workers replay this much on startup
+	VideoCancelMaxAge = 24 * time.Hour
+)
+
+// Queue types, sent as x-queue-type. Empty means a classic queue.
+const (
+	QueueTypeClassic = "classic"
+	QueueTypeQuorum  = "quorum"
+	QueueTypeStream  = "stream"
+)
+
+type Exchange struct {
+	Name string
+	Kind string // direct, fanout or topic
+}
+
+type Queue struct {
+	Name    string
+	Durable bool
+	Type    string
+
+	DeadLetterExchange   string
+	DeadLetterRoutingKey string
+	MessageTTL           time.Duration
+
+	// Quorum queues dead-letter a message requeued more than DeliveryLimit times
+	DeliveryLimit int
+	// Streams drop segments older than MaxAge
+	MaxAge time.Duration
+	// Classic queues order messages by priority up to MaxPriority. Quorum
+	// queues always have two levels (0-4 and 5+) and take no setting.
+	MaxPriority uint8
+}
+
+type Binding struct {
+	Queue    string
+	Exchange string
+	Key      string
+}
+
+// Topology describes every exchange, queue and binding a service relies on.
+// Both binaries apply the same one at startup, so it does not matter which
+// starts first.
+type Topology struct {
+	Exchanges []Exchange
+	Queues    []Queue
+	Bindings  []Binding
+}
+
+// Queue looks up a queue by name.
+func (t Topology) Queue(name string) (Queue, bool) {
+	for _, q := range t.Queues {
+		if q.Name == name {
+			return q, true
+		}
+	}
+	return Queue{}, false
+}
+
+// Print writes the topology one declaration per line, for ops to compare
+// against what the broker has.
+func (t Topology) Print(w io.Writer) error {
+	for _, e := range t.Exchanges {
+		if _, err := fmt.Fprintf(w, "exchange %s %s\n", e.Name, e.Kind); err != nil {
+			return err
+		}
+	}
+	for _, q := range t.Queues {
+		attrs := []string{"transient"}
+		if q.Durable {
+			attrs[0] = "durable"
+		}
+		queueType := q.Type
+		if queueType == "" {
+			queueType = QueueTypeClassic
+		}
+		attrs = append(attrs, "type="+queueType)
+		if q.DeadLetterExchange != "" {
+			attrs = append(attrs, "dlx="+q.DeadLetterExchange)
+		}
+		if q.DeadLetterRoutingKey != "" {
+			attrs = append(attrs, "dlx-key="+q.DeadLetterRoutingKey)
+		}
+		if q.MessageTTL > 0 {
+			attrs = append(attrs, "ttl="+q.MessageTTL.String())
+		}
+		if q.DeliveryLimit > 0 {
+			attrs = append(attrs, fmt.Sprintf("delivery-limit=%d", q.DeliveryLimit))
+		}
+		if q.MaxAge > 0 {
+			attrs = append(attrs, "max-age="+q.MaxAge.String())
+		}
+		if q.MaxPriority > 0 {
+			attrs = append(attrs, fmt.Sprintf("max-priority=%d", q.MaxPriority))
+		}
+		if _, err := fmt.Fprintf(w, "queue %s %s\n", q.Name, strings.Join(attrs, " ")); err != nil {
+			return err
+		}
+	}
+	for _, b := range t.Bindings {
+		if _, err := fmt.Fprintf(w, "binding %s -> %s key=%q\n", b.Exchange, b.Queue, b.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VideoTopology is the broker layout for video processing. Delayed retry
+// queues are not listed: the worker declares them from its retry policy.
+var VideoTopology = Topology{
+	Exchanges: []Exchange{
+		{Name: ExchangeVideoTopic, Kind: "topic"},
+		{Name: ExchangeVideoDLX, Kind: "fanout"},
+	},
+	Queues: []Queue{
+		// A job that keeps crashing the worker is dead-lettered after VideoDeliveryLimit redeliveries
+		{Name: VideoQueue, Durable: true, Type: QueueTypeQuorum, DeadLetterExchange: ExchangeVideoDLX, DeliveryLimit: VideoDeliveryLimit},
+		{Name: VideoDLQueue, Durable: true},
+		// Probe requests that fail are answered with an error, never dead-lettered
+		{Name: VideoProbeQueue, Durable: true},
+		{Name: VideoEventsStream, Durable: true, Type: QueueTypeStream, MaxAge: VideoEventsMaxAge},
+		// Lifecycle events from the workers, applied to the database by the API
+		{Name: VideoStatusQueue, Durable: true, Type: QueueTypeQuorum},
+		// Every worker reads every cancellation, so they go to a stream rather than a queue
+		{Name: VideoCancelStream, Durable: true, Type: QueueTypeStream, MaxAge: VideoCancelMaxAge},
+		// Pipeline steps, one queue per kind. A step that gives up is reported to the
+		// API, which fails the run, and dead-lettered like a job; so is one the
+		// subscriber never hands to the handler, such as a poison or undecodable step.
+		{Name: StepQueue(StepProbe), Durable: true, Type: QueueTypeQuorum, DeadLetterExchange: ExchangeVideoDLX, DeliveryLimit: VideoDeliveryLimit},
+		{Name: StepQueue(StepThumbnail), Durable: true, Type: QueueTypeQuorum, DeadLetterExchange: ExchangeVideoDLX, DeliveryLimit: VideoDeliveryLimit},
+		{Name: StepQueue(StepTranscode), Durable: true, Type: QueueTypeQuorum, DeadLetterExchange: ExchangeVideoDLX, DeliveryLimit: VideoDeliveryLimit},
+		{Name: StepQueue(StepPackage), Durable: true, Type: QueueTypeQuorum, DeadLetterExchange: ExchangeVideoDLX, DeliveryLimit: VideoDeliveryLimit},
+		{Name: StepQueue(StepPublish), Durable: true, Type: QueueTypeQuorum, DeadLetterExchange: ExchangeVideoDLX, DeliveryLimit: VideoDeliveryLimit},
+		// Step results, applied to the run by the API
+		{Name: StepResultQueue, Durable: true, Type: QueueTypeQuorum},
+	},
+	Bindings: []Binding{
+		{Queue: VideoQueue, Exchange: ExchangeVideoTopic, Key: VideoUploadKey},
+		{Queue: VideoDLQueue, Exchange: ExchangeVideoDLX, Key: ""},
+		{Queue: VideoProbeQueue, Exchange: ExchangeVideoTopic, Key: VideoProbeKey},
+		{Queue: VideoEventsStream, Exchange: ExchangeVideoTopic, Key: VideoProcessingKey},
+		{Queue: VideoEventsStream, Exchange: ExchangeVideoTopic, Key: VideoProgressKey},
+		{Queue: VideoEventsStream, Exchange: ExchangeVideoTopic, Key: VideoCompletedKey},
+		{Queue: VideoEventsStream, Exchange: ExchangeVideoTopic, Key: VideoFailedKey},
+		{Queue: VideoStatusQueue, Exchange: ExchangeVideoTopic, Key: VideoProcessingKey},
+		{Queue: VideoStatusQueue, Exchange: ExchangeVideoTopic, Key: VideoProgressKey},
+		{Queue: VideoStatusQueue, Exchange: ExchangeVideoTopic, Key: VideoCompletedKey},
+		{Queue: VideoStatusQueue, Exchange: ExchangeVideoTopic, Key: VideoFailedKey},
+		{Queue: VideoCancelStream, Exchange: ExchangeVideoTopic, Key: VideoCancelKey},
+		{Queue: StepQueue(StepProbe), Exchange: ExchangeVideoTopic, Key: StepKey(StepProbe)},
+		{Queue: StepQueue(StepThumbnail), Exchange: ExchangeVideoTopic, Key: StepKey(StepThumbnail)},
+		{Queue: StepQueue(StepTranscode), Exchange: ExchangeVideoTopic, Key: StepKey(StepTranscode)},
+		{Queue: StepQueue(StepPackage), Exchange: ExchangeVideoTopic, Key: StepKey(StepPackage)},
+		{Queue: StepQueue(StepPublish), Exchange: ExchangeVideoTopic, Key: StepKey(StepPublish)},
+		{Queue: StepResultQueue, Exchange: ExchangeVideoTopic, Key: StepResultKey},
+	},
+}
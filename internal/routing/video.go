@@ -8,6 +8,42 @@ type VideoJob struct {
 	TargetFormat string    `json:"target_format"`
 	UserID       string    `json:"user_id"`
 	CreatedAt    time.Time `json:"created_at"`
+	Priority     uint8     `json:"priority"`
+}
+
+// MessagePriority makes Publish send the job with its priority.
+func (j VideoJob) MessagePriority() uint8 {
+	return j.Priority
+}
+
+// Job priorities. Quorum queues hand out anything above 4 before the rest, so
+// a PriorityHigh job overtakes every queued PriorityNormal one.
+const (
+	PriorityNormal uint8 = 2
+	PriorityHigh   uint8 = 6
+
+	// Uploads up to this size are short clips and skip ahead of long files
+	SmallUploadBytes = 50 << 20
+	TierPro          = "pro"
+)
+
+// JobPriority picks the lane for a job: explicit re-processing, paying
+// creators and small files go first.
+func JobPriority(sizeBytes int64, tier string, reprocess bool) uint8 {
+	if reprocess || tier == TierPro || sizeBytes <= SmallUploadBytes {
+		return PriorityHigh
+	}
+	return PriorityNormal
+}
+
+// ProbeRequest asks a worker to inspect a stored video, answered with a ProbeResult.
+type ProbeRequest struct {
+	VideoID    string `json:"video_id"`
+	SourcePath string `json:"source_path"`
+}
+
+type ProbeResult struct {
+	DurationSeconds float64 `json:"duration_seconds"`
 }
 
 const (
@@ -16,4 +52,8 @@ const (
 	VideoQueue         = "video_processing"
 	ExchangeVideoDLX   = "video_dlx"
 	VideoDLQueue       = "video_processing_failed"
+	VideoProbeKey      = "video.probe"
+	VideoProbeQueue    = "video_probe"
+	VideoEventsStream  = "video_events"
+	VideoCancelStream  = "video_cancellations"
 )
@@ -1,16 +1,20 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
 func UploadToS3(filename string, file io.Reader) (string, error) {
@@ -90,3 +94,128 @@ func DeleteFromS3(filename string) error {
 
 	return err
 }
+
+const (
+	// messagesPrefix keeps offloaded message bodies apart from the public
+	// videos and thumbnails.
+	messagesPrefix        = "messages/"
+	messagesLifecycleRule = "expire-offloaded-messages"
+
+	// MessageRetentionDays outlives the 30 days the events stream keeps
+	// messages, so replays can still restore their bodies.
+	MessageRetentionDays = 45
+)
+
+// Blobs stores message bodies offloaded by pubsub.PayloadBroker in the
+// bucket under messages/, readable only with the service's credentials.
+// References look like s3://bucket/messages/<key>.
+type Blobs struct{}
+
+func (Blobs) Put(ctx context.Context, key string, data []byte) (string, error) {
+	bucket := os.Getenv("S3_BUCKET_NAME")
+	client, err := newClient(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	key = messagesPrefix + key
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return "", err
+	}
+	return "s3://" + bucket + "/" + key, nil
+}
+
+func (Blobs) Get(ctx context.Context, ref string) ([]byte, error) {
+	location, ok := strings.CutPrefix(ref, "s3://")
+	if !ok {
+		// Bodies offloaded before they were private are public URLs
+		return getURL(ctx, ref)
+	}
+	bucket, key, ok := strings.Cut(location, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid blob reference %q", ref)
+	}
+
+	client, err := newClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+// ExpireMessages adds a lifecycle rule to the bucket that deletes offloaded
+// message bodies after MessageRetentionDays, keeping its other rules.
+func ExpireMessages(ctx context.Context) error {
+	bucket := os.Getenv("S3_BUCKET_NAME")
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	var rules []types.LifecycleRule
+	current, err := client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(bucket),
+	})
+	var apiErr smithy.APIError
+	switch {
+	case err == nil:
+		for _, rule := range current.Rules {
+			if aws.ToString(rule.ID) != messagesLifecycleRule {
+				rules = append(rules, rule)
+			}
+		}
+	case errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchLifecycleConfiguration":
+	default:
+		return err
+	}
+
+	rules = append(rules, types.LifecycleRule{
+		ID:         aws.String(messagesLifecycleRule),
+		Status:     types.ExpirationStatusEnabled,
+		Filter:     &types.LifecycleRuleFilter{Prefix: aws.String(messagesPrefix)},
+		Expiration: &types.LifecycleExpiration{Days: aws.Int32(MessageRetentionDays)},
+	})
+	_, err = client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(bucket),
+		LifecycleConfiguration: &types.BucketLifecycleConfiguration{Rules: rules},
+	})
+	return err
+}
+
+func newClient(ctx context.Context) (*s3.Client, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(os.Getenv("AWS_REGION")))
+	if err != nil {
+		return nil, err
+	}
+	return s3.NewFromConfig(cfg), nil
+}
+
+func getURL(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status: %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
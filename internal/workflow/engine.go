@@ -0,0 +1,444 @@
+// Package workflow runs routing.Pipelines on top of internal/pubsub. Every
+// step of a run is a message of its own, queued through the outbox once the
+// steps it needs are done, retried by the worker that runs it and tracked
+// in workflow_runs and workflow_steps.
+package workflow
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/JerryG0311/Vidify/internal/pubsub"
+	"github.com/JerryG0311/Vidify/internal/routing"
+)
+
+// Run statuses
+const (
+	RunRunning   = "RUNNING"
+	RunCompleted = "COMPLETED"
+	RunFailed    = "FAILED"
+	RunCancelled = "CANCELLED"
+)
+
+// Step statuses. A step is PENDING until the steps it needs are done, then
+// QUEUED until a worker reports it DONE or, after its last retry, FAILED.
+// A queued step's queued_at moves on with each retry the worker reports.
+const (
+	StepPending = "PENDING"
+	StepQueued  = "QUEUED"
+	StepDone    = "DONE"
+	StepFailed  = "FAILED"
+)
+
+// ArtifactsOutput is the output a step lists the storage keys it wrote in,
+// comma separated, so they can be removed with the video.
+const ArtifactsOutput = "s3_keys"
+
+// ErrUnknownRun is returned for results of a run that does not exist, such
+// as one whose video was deleted.
+var ErrUnknownRun = errors.New("workflow: unknown run")
+
+// Engine keeps the state of pipeline runs in the database. Every change
+// happens inside the caller's transaction, together with the outbox rows of
+// the steps it queues.
+type Engine struct {
+	db *sql.DB
+}
+
+func NewEngine(db *sql.DB) *Engine {
+	return &Engine{db: db}
+}
+
+type Run struct {
+	ID         string
+	VideoID    string
+	UserID     string
+	Pipeline   string
+	SourcePath string
+	Priority   uint8
+	Status     string
+	Error      string
+	StartedAt  time.Time
+}
+
+type Step struct {
+	Name     string
+	Kind     string
+	Status   string
+	Attempts int
+	Outputs  map[string]string
+	Error    string
+}
+
+// Start creates a run of the pipeline for job's target format and queues its
+// first steps. runID is the job's message ID, so a redelivered job starts
+// nothing and Start reports false. A run still going for the same video is
+// cancelled: the new job replaces it.
+func (e *Engine) Start(ctx context.Context, tx *sql.Tx, runID string, job routing.VideoJob) (bool, error) {
+	pipeline, err := routing.PipelineFor(job.TargetFormat)
+	if err != nil {
+		return false, err
+	}
+	if err := pipeline.Validate(); err != nil {
+		return false, err
+	}
+
+	now := time.Now().UTC()
+	result, err := tx.ExecContext(ctx,
+		"INSERT OR IGNORE INTO workflow_runs (id, video_id, user_id, pipeline, source_path, priority, status, started_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		runID, job.ID, job.UserID, pipeline.Name, job.SourcePath, job.Priority, RunRunning, now,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE workflow_runs SET status = ?, error = ?, finished_at = ? WHERE video_id = ? AND status = ? AND id != ?",
+		RunCancelled, "replaced by run "+runID, now, job.ID, RunRunning, runID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	for _, step := range pipeline.Steps {
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO workflow_steps (run_id, name, kind, status) VALUES (?, ?, ?, ?)",
+			runID, step.Name, step.Kind, StepPending,
+		)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, e.advance(ctx, tx, runID)
+}
+
+// Record applies a worker's result to its step. A done step passes its
+// outputs on and queues every step that was only waiting for it; a step that
+// failed for good fails the run. Results for a step that is no longer
+// queued, or a run that is over, are duplicates or late and change nothing.
+func (e *Engine) Record(ctx context.Context, tx *sql.Tx, result routing.StepResult) (Run, error) {
+	run, err := loadRun(ctx, tx, result.RunID)
+	if err != nil {
+		return run, err
+	}
+	if run.Status != RunRunning {
+		return run, nil
+	}
+
+	var status string
+	err = tx.QueryRowContext(ctx,
+		"SELECT status FROM workflow_steps WHERE run_id = ? AND name = ?", result.RunID, result.Step,
+	).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return run, fmt.Errorf("workflow: run %s has no step %q", result.RunID, result.Step)
+	}
+	if err != nil || status != StepQueued {
+		return run, err
+	}
+
+	now := time.Now().UTC()
+	if result.Error != "" {
+		if result.Retrying {
+			_, err = tx.ExecContext(ctx,
+				"UPDATE workflow_steps SET attempts = attempts + 1, error = ?, queued_at = ? WHERE run_id = ? AND name = ?",
+				result.Error, now, result.RunID, result.Step,
+			)
+			return run, err
+		}
+
+		_, err = tx.ExecContext(ctx,
+			"UPDATE workflow_steps SET status = ?, attempts = attempts + 1, error = ?, finished_at = ? WHERE run_id = ? AND name = ?",
+			StepFailed, result.Error, now, result.RunID, result.Step,
+		)
+		if err != nil {
+			return run, err
+		}
+		run.Status = RunFailed
+		run.Error = fmt.Sprintf("%s: %s", result.Step, result.Error)
+		_, err = tx.ExecContext(ctx,
+			"UPDATE workflow_runs SET status = ?, error = ?, finished_at = ? WHERE id = ?",
+			run.Status, run.Error, now, run.ID,
+		)
+		return run, err
+	}
+
+	outputs, err := json.Marshal(result.Outputs)
+	if err != nil {
+		return run, err
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE workflow_steps SET status = ?, attempts = attempts + 1, outputs = ?, error = '', finished_at = ? WHERE run_id = ? AND name = ?",
+		StepDone, string(outputs), now, result.RunID, result.Step,
+	)
+	if err != nil {
+		return run, err
+	}
+	if err := e.advance(ctx, tx, run.ID); err != nil {
+		return run, err
+	}
+	return loadRun(ctx, tx, run.ID)
+}
+
+// FailStale fails every running run with a step queued before before that
+// no worker has reported on since, such as one that was dead-lettered or
+// dropped by the broker, and returns the runs it failed.
+func (e *Engine) FailStale(ctx context.Context, tx *sql.Tx, before time.Time) ([]Run, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT s.run_id, s.name, s.queued_at
+		FROM workflow_steps s
+		JOIN workflow_runs r ON r.id = s.run_id
+		WHERE r.status = ? AND s.status = ? AND s.queued_at < ?
+		ORDER BY s.queued_at`,
+		RunRunning, StepQueued, before,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	type staleStep struct {
+		runID, name string
+		queuedAt    time.Time
+	}
+	var stale []staleStep
+	for rows.Next() {
+		var step staleStep
+		if err := rows.Scan(&step.runID, &step.name, &step.queuedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stale = append(stale, step)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	var failed []Run
+	for _, step := range stale {
+		run, err := loadRun(ctx, tx, step.runID)
+		if err != nil {
+			return nil, err
+		}
+		// A run with two silent steps is failed by the first
+		if run.Status != RunRunning {
+			continue
+		}
+
+		message := fmt.Sprintf("no result since %s", step.queuedAt.Format(time.RFC3339))
+		_, err = tx.ExecContext(ctx,
+			"UPDATE workflow_steps SET status = ?, error = ?, finished_at = ? WHERE run_id = ? AND name = ?",
+			StepFailed, message, now, step.runID, step.name,
+		)
+		if err != nil {
+			return nil, err
+		}
+		run.Status = RunFailed
+		run.Error = fmt.Sprintf("%s: %s", step.name, message)
+		_, err = tx.ExecContext(ctx,
+			"UPDATE workflow_runs SET status = ?, error = ?, finished_at = ? WHERE id = ?",
+			run.Status, run.Error, now, run.ID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		failed = append(failed, run)
+	}
+	return failed, nil
+}
+
+// advance queues every pending step whose needs are all done and completes
+// the run once every step is.
+func (e *Engine) advance(ctx context.Context, tx *sql.Tx, runID string) error {
+	run, err := loadRun(ctx, tx, runID)
+	if err != nil {
+		return err
+	}
+	pipeline, err := routing.PipelineFor(run.Pipeline)
+	if err != nil {
+		return err
+	}
+	steps, err := loadSteps(ctx, tx, runID)
+	if err != nil {
+		return err
+	}
+	byName := map[string]Step{}
+	for _, step := range steps {
+		byName[step.Name] = step
+	}
+
+	done := 0
+	for i, def := range pipeline.Steps {
+		step, ok := byName[def.Name]
+		if !ok {
+			return fmt.Errorf("workflow: run %s has no row for step %s", runID, def.Name)
+		}
+		if step.Status == StepDone {
+			done++
+			continue
+		}
+		if step.Status != StepPending {
+			continue
+		}
+
+		inputs, ready := map[string]string{}, true
+		for _, need := range def.Needs {
+			dependency := byName[need]
+			if dependency.Status != StepDone {
+				ready = false
+				break
+			}
+			for key, value := range dependency.Outputs {
+				inputs[need+"."+key] = value
+			}
+		}
+		if !ready {
+			continue
+		}
+
+		task := routing.StepTask{
+			RunID:      run.ID,
+			VideoID:    run.VideoID,
+			SourcePath: run.SourcePath,
+			Step:       def.Name,
+			Kind:       def.Kind,
+			Needs:      def.Needs,
+			Params:     def.Params,
+			Inputs:     inputs,
+			Percent:    (i + 1) * 100 / len(pipeline.Steps),
+			StartedAt:  run.StartedAt,
+			Priority:   run.Priority,
+		}
+		if err := pubsub.Enqueue(ctx, tx, pubsub.JSON, routing.ExchangeVideoTopic, routing.StepKey(def.Kind), task); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx,
+			"UPDATE workflow_steps SET status = ?, queued_at = ? WHERE run_id = ? AND name = ?",
+			StepQueued, time.Now().UTC(), runID, def.Name,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if done < len(pipeline.Steps) {
+		return nil
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE workflow_runs SET status = ?, finished_at = ? WHERE id = ?",
+		RunCompleted, time.Now().UTC(), runID,
+	)
+	return err
+}
+
+// Latest returns the most recent run for a video and its steps in pipeline
+// order, or sql.ErrNoRows if the video never had one.
+func (e *Engine) Latest(ctx context.Context, videoID string) (Run, []Step, error) {
+	var runID string
+	err := e.db.QueryRowContext(ctx,
+		"SELECT id FROM workflow_runs WHERE video_id = ? ORDER BY started_at DESC, rowid DESC LIMIT 1", videoID,
+	).Scan(&runID)
+	if err != nil {
+		return Run{}, nil, err
+	}
+
+	tx, err := e.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return Run{}, nil, err
+	}
+	defer tx.Rollback()
+
+	run, err := loadRun(ctx, tx, runID)
+	if err != nil {
+		return run, nil, err
+	}
+	steps, err := loadSteps(ctx, tx, runID)
+	return run, steps, err
+}
+
+// Delete forgets every run of a video inside tx and returns the storage keys
+// their steps wrote. Results still on their way are then ignored.
+func (e *Engine) Delete(ctx context.Context, tx *sql.Tx, videoID string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx,
+		"SELECT s.outputs FROM workflow_steps s JOIN workflow_runs r ON r.id = s.run_id WHERE r.video_id = ?", videoID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := map[string]bool{}
+	var keys []string
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		var outputs map[string]string
+		if err := json.Unmarshal([]byte(raw), &outputs); err != nil {
+			continue
+		}
+		for _, key := range strings.Split(outputs[ArtifactsOutput], ",") {
+			if key != "" && !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM workflow_steps WHERE run_id IN (SELECT id FROM workflow_runs WHERE video_id = ?)", videoID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM workflow_runs WHERE video_id = ?", videoID); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func loadRun(ctx context.Context, tx *sql.Tx, runID string) (Run, error) {
+	var run Run
+	err := tx.QueryRowContext(ctx,
+		"SELECT id, video_id, user_id, pipeline, source_path, priority, status, error, started_at FROM workflow_runs WHERE id = ?", runID,
+	).Scan(&run.ID, &run.VideoID, &run.UserID, &run.Pipeline, &run.SourcePath, &run.Priority, &run.Status, &run.Error, &run.StartedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return run, fmt.Errorf("%w %s", ErrUnknownRun, runID)
+	}
+	return run, err
+}
+
+// loadSteps returns a run's steps in the order they were inserted, which is
+// pipeline order.
+func loadSteps(ctx context.Context, tx *sql.Tx, runID string) ([]Step, error) {
+	rows, err := tx.QueryContext(ctx,
+		"SELECT name, kind, status, attempts, outputs, error FROM workflow_steps WHERE run_id = ? ORDER BY rowid", runID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var steps []Step
+	for rows.Next() {
+		var step Step
+		var outputs string
+		if err := rows.Scan(&step.Name, &step.Kind, &step.Status, &step.Attempts, &outputs, &step.Error); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(outputs), &step.Outputs); err != nil {
+			return nil, fmt.Errorf("workflow: outputs of %s/%s: %w", runID, step.Name, err)
+		}
+		steps = append(steps, step)
+	}
+	return steps, rows.Err()
+}
@@ -0,0 +1,263 @@
+package workflow
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JerryG0311/Vidify/internal/routing"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openDB returns an in-memory database migrated with the outbox and workflow
+// migrations from sql/schema.
+func openDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	for _, name := range []string{
+		"20260322000100_create_outbox.sql",
+		"20260322000200_add_priority_to_outbox.sql",
+		"20260322000700_create_workflow_runs.sql",
+	} {
+		migration, err := os.ReadFile(filepath.Join("..", "..", "sql", "schema", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		up, _, _ := strings.Cut(string(migration), "-- +goose Down")
+		if _, err := db.Exec(up); err != nil {
+			t.Fatalf("apply %s: %v", name, err)
+		}
+	}
+	return db
+}
+
+// queued returns the tasks in the outbox that are not yet read, by step name.
+func queued(t *testing.T, db *sql.DB, after *int64) map[string]routing.StepTask {
+	t.Helper()
+
+	rows, err := db.Query("SELECT id, routing_key, body FROM outbox WHERE id > ? ORDER BY id", *after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	tasks := map[string]routing.StepTask{}
+	for rows.Next() {
+		var key string
+		var body []byte
+		if err := rows.Scan(after, &key, &body); err != nil {
+			t.Fatal(err)
+		}
+		var task routing.StepTask
+		if err := json.Unmarshal(body, &task); err != nil {
+			t.Fatal(err)
+		}
+		if key != routing.StepKey(task.Kind) {
+			t.Errorf("%s task for step %s sent with key %s", task.Kind, task.Step, key)
+		}
+		tasks[task.Step] = task
+	}
+	return tasks
+}
+
+func inTx(t *testing.T, db *sql.DB, fn func(tx *sql.Tx) error) {
+	t.Helper()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func stepNames(tasks map[string]routing.StepTask) []string {
+	var names []string
+	for _, step := range routing.Pipelines[routing.FormatMP4].Steps {
+		if _, ok := tasks[step.Name]; ok {
+			names = append(names, step.Name)
+		}
+	}
+	return names
+}
+
+func TestStepsAreQueuedOnceTheirNeedsAreDone(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	engine := NewEngine(db)
+	job := routing.VideoJob{ID: "vid-1", SourcePath: "https://bucket/vid-1.mp4", TargetFormat: routing.FormatMP4, UserID: "a@example.com", Priority: routing.PriorityHigh}
+	var seen int64
+
+	inTx(t, db, func(tx *sql.Tx) error {
+		started, err := engine.Start(ctx, tx, "run-1", job)
+		if err == nil && !started {
+			t.Error("expected the first delivery of a job to start a run")
+		}
+		return err
+	})
+	inTx(t, db, func(tx *sql.Tx) error {
+		started, err := engine.Start(ctx, tx, "run-1", job)
+		if err == nil && started {
+			t.Error("expected a redelivered job not to start a second run")
+		}
+		return err
+	})
+
+	tasks := queued(t, db, &seen)
+	if names := stepNames(tasks); len(names) != 1 || names[0] != "probe" {
+		t.Fatalf("expected only the probe queued first, got %v", names)
+	}
+	if tasks["probe"].Priority != routing.PriorityHigh || tasks["probe"].SourcePath != job.SourcePath {
+		t.Errorf("probe task lost the job's priority or source: %+v", tasks["probe"])
+	}
+
+	record := func(result routing.StepResult) Run {
+		var run Run
+		inTx(t, db, func(tx *sql.Tx) error {
+			var err error
+			run, err = engine.Record(ctx, tx, result)
+			return err
+		})
+		return run
+	}
+
+	record(routing.StepResult{RunID: "run-1", Step: "probe", Outputs: map[string]string{"duration_seconds": "12.5"}})
+	if names := stepNames(queued(t, db, &seen)); len(names) != 2 || names[0] != "thumbnail" || names[1] != "transcode" {
+		t.Fatalf("expected thumbnail and transcode after the probe, got %v", names)
+	}
+
+	// A retry is tracked without queuing anything; a duplicate result changes nothing
+	record(routing.StepResult{RunID: "run-1", Step: "transcode", Error: "upload: timeout", Retrying: true})
+	record(routing.StepResult{RunID: "run-1", Step: "probe", Outputs: map[string]string{"duration_seconds": "99"}})
+	record(routing.StepResult{RunID: "run-1", Step: "thumbnail", Outputs: map[string]string{"url": "https://bucket/vid-1_thumb.jpg"}})
+	if tasks := queued(t, db, &seen); len(tasks) != 0 {
+		t.Fatalf("expected publish to wait for the transcode, got %v", stepNames(tasks))
+	}
+
+	record(routing.StepResult{RunID: "run-1", Step: "transcode", Outputs: map[string]string{"url": "https://bucket/vid-1_processed.mp4", ArtifactsOutput: "vid-1_processed.mp4"}})
+	publish, ok := queued(t, db, &seen)["publish"]
+	if !ok {
+		t.Fatal("expected publish to be queued once all its needs were done")
+	}
+	if publish.Input("transcode", "url") != "https://bucket/vid-1_processed.mp4" || publish.Input("probe", "duration_seconds") != "12.5" {
+		t.Errorf("publish did not get the outputs of its needs: %v", publish.Inputs)
+	}
+	if publish.Percent != 100 {
+		t.Errorf("expected the last step to finish the run at 100%%, got %d", publish.Percent)
+	}
+
+	if run := record(routing.StepResult{RunID: "run-1", Step: "publish"}); run.Status != RunCompleted {
+		t.Fatalf("expected the run to complete, got %s", run.Status)
+	}
+
+	_, steps, err := engine.Latest(ctx, "vid-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if steps[2].Name != "transcode" || steps[2].Attempts != 2 || steps[2].Status != StepDone {
+		t.Errorf("expected transcode done after 2 attempts, got %+v", steps[2])
+	}
+
+	inTx(t, db, func(tx *sql.Tx) error {
+		keys, err := engine.Delete(ctx, tx, "vid-1")
+		if err == nil && (len(keys) != 1 || keys[0] != "vid-1_processed.mp4") {
+			t.Errorf("expected the transcode's file to be returned for deletion, got %v", keys)
+		}
+		return err
+	})
+}
+
+func TestFailedStepFailsTheRun(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	engine := NewEngine(db)
+	var seen int64
+
+	inTx(t, db, func(tx *sql.Tx) error {
+		_, err := engine.Start(ctx, tx, "run-1", routing.VideoJob{ID: "vid-1", TargetFormat: routing.FormatHLS})
+		return err
+	})
+
+	var run Run
+	inTx(t, db, func(tx *sql.Tx) error {
+		var err error
+		run, err = engine.Record(ctx, tx, routing.StepResult{RunID: "run-1", Step: "probe", Error: "ffprobe: invalid data"})
+		return err
+	})
+	if run.Status != RunFailed || run.Error != "probe: ffprobe: invalid data" {
+		t.Fatalf("expected the run to fail on the probe, got %s %q", run.Status, run.Error)
+	}
+
+	queued(t, db, &seen)
+	inTx(t, db, func(tx *sql.Tx) error {
+		_, err := engine.Record(ctx, tx, routing.StepResult{RunID: "run-1", Step: "probe", Outputs: map[string]string{}})
+		return err
+	})
+	if tasks := queued(t, db, &seen); len(tasks) != 0 {
+		t.Fatalf("expected a late result for a failed run to queue nothing, got %v", tasks)
+	}
+
+	inTx(t, db, func(tx *sql.Tx) error {
+		_, err := engine.Start(ctx, tx, "run-2", routing.VideoJob{ID: "vid-2", TargetFormat: "webm"})
+		if err == nil {
+			t.Error("expected a job for an unknown format to be refused")
+		}
+		return nil
+	})
+}
+
+func TestSilentStepFailsTheRun(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	engine := NewEngine(db)
+
+	for _, runID := range []string{"run-1", "run-2"} {
+		inTx(t, db, func(tx *sql.Tx) error {
+			_, err := engine.Start(ctx, tx, runID, routing.VideoJob{ID: "vid-" + runID, TargetFormat: routing.FormatMP4})
+			return err
+		})
+	}
+	if _, err := db.Exec("UPDATE workflow_steps SET queued_at = ? WHERE status = ?", time.Now().UTC().Add(-2*time.Hour), StepQueued); err != nil {
+		t.Fatal(err)
+	}
+	// A retry is news from the worker, so run-2's probe is not silent
+	inTx(t, db, func(tx *sql.Tx) error {
+		_, err := engine.Record(ctx, tx, routing.StepResult{RunID: "run-2", Step: "probe", Error: "download: timeout", Retrying: true})
+		return err
+	})
+
+	var failed []Run
+	inTx(t, db, func(tx *sql.Tx) error {
+		var err error
+		failed, err = engine.FailStale(ctx, tx, time.Now().UTC().Add(-time.Hour))
+		return err
+	})
+	if len(failed) != 1 || failed[0].ID != "run-1" || failed[0].Status != RunFailed {
+		t.Fatalf("expected only run-1 to fail, got %+v", failed)
+	}
+
+	run, steps, err := engine.Latest(ctx, "vid-run-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != RunFailed || steps[0].Status != StepFailed || !strings.HasPrefix(run.Error, "probe: no result since ") {
+		t.Fatalf("expected the run failed on its probe, got %s %q and %+v", run.Status, run.Error, steps[0])
+	}
+}
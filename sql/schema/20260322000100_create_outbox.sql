@@ -0,0 +1,23 @@
+-- +goose Up
+CREATE TABLE outbox (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id TEXT NOT NULL UNIQUE,
+    exchange TEXT NOT NULL,
+    routing_key TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    correlation_id TEXT NOT NULL DEFAULT '',
+    headers TEXT NOT NULL DEFAULT '{}',
+    body BLOB NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    sent_at DATETIME
+);
+
+CREATE INDEX idx_outbox_sent_at ON outbox(sent_at);
+
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_outbox_sent_at;
+
+DROP TABLE IF EXISTS outbox;
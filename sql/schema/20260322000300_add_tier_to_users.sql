@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN tier TEXT NOT NULL DEFAULT 'free';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down migration not supported in sqlite for column drop';
+-- +goose StatementEnd
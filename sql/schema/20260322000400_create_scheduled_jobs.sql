@@ -0,0 +1,22 @@
+-- +goose Up
+CREATE TABLE scheduled_jobs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    job_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    priority INTEGER NOT NULL DEFAULT 0,
+    body BLOB NOT NULL,
+    correlation_id TEXT NOT NULL DEFAULT '',
+    trace_parent TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    dispatched_at DATETIME
+);
+
+CREATE INDEX idx_scheduled_jobs_user_dispatched ON scheduled_jobs(user_id, dispatched_at);
+CREATE INDEX idx_scheduled_jobs_job_id ON scheduled_jobs(job_id);
+
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_scheduled_jobs_job_id;
+DROP INDEX IF EXISTS idx_scheduled_jobs_user_dispatched;
+
+DROP TABLE IF EXISTS scheduled_jobs;
@@ -0,0 +1,22 @@
+-- +goose Up
+CREATE TABLE delayed_jobs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    job_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    run_at DATETIME NOT NULL,
+    body BLOB NOT NULL,
+    correlation_id TEXT NOT NULL DEFAULT '',
+    trace_parent TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    dispatched_at DATETIME
+);
+
+CREATE INDEX idx_delayed_jobs_run_at ON delayed_jobs(dispatched_at, run_at);
+CREATE INDEX idx_delayed_jobs_job_id ON delayed_jobs(job_id);
+
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_delayed_jobs_job_id;
+DROP INDEX IF EXISTS idx_delayed_jobs_run_at;
+
+DROP TABLE IF EXISTS delayed_jobs;
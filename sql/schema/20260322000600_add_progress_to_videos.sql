@@ -0,0 +1,10 @@
+-- +goose Up
+ALTER TABLE videos ADD COLUMN progress INTEGER DEFAULT 0;
+ALTER TABLE videos ADD COLUMN last_error TEXT DEFAULT '';
+ALTER TABLE videos ADD COLUMN duration_seconds REAL DEFAULT 0;
+
+
+-- +goose Down
+ALTER TABLE videos DROP COLUMN duration_seconds;
+ALTER TABLE videos DROP COLUMN last_error;
+ALTER TABLE videos DROP COLUMN progress;
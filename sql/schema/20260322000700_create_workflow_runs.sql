@@ -0,0 +1,35 @@
+-- +goose Up
+CREATE TABLE workflow_runs (
+    id TEXT PRIMARY KEY,
+    video_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    pipeline TEXT NOT NULL,
+    source_path TEXT NOT NULL,
+    priority INTEGER NOT NULL DEFAULT 0,
+    status TEXT NOT NULL DEFAULT 'RUNNING',
+    error TEXT NOT NULL DEFAULT '',
+    started_at DATETIME NOT NULL,
+    finished_at DATETIME
+);
+
+CREATE INDEX idx_workflow_runs_video_id ON workflow_runs(video_id, started_at);
+
+CREATE TABLE workflow_steps (
+    run_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'PENDING',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    outputs TEXT NOT NULL DEFAULT '{}',
+    error TEXT NOT NULL DEFAULT '',
+    queued_at DATETIME,
+    finished_at DATETIME,
+    PRIMARY KEY (run_id, name)
+);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS workflow_steps;
+
+DROP INDEX IF EXISTS idx_workflow_runs_video_id;
+DROP TABLE IF EXISTS workflow_runs;
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE scheduled_jobs ADD COLUMN failed_at DATETIME;
+ALTER TABLE scheduled_jobs ADD COLUMN last_error TEXT NOT NULL DEFAULT '';
+ALTER TABLE delayed_jobs ADD COLUMN failed_at DATETIME;
+ALTER TABLE delayed_jobs ADD COLUMN last_error TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down migration not supported in sqlite for column drop';
+-- +goose StatementEnd